@@ -0,0 +1,235 @@
+package be
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// 削除を申請してから実際に削除するまでの猶予 (この間は取り消せる)
+	AccountDeletionGrace           = 7 * 24 * time.Hour
+	AccountDeletionSchedulerPeriod = time.Hour
+)
+
+// ユーザーに関するデータを全て削除する
+// 抜けたグループの ID を返す
+func purgeMember(tx *gorm.DB, userId uint) ([]uint, error) {
+	var user Member
+	if err := tx.First(&user, userId).Error; err != nil {
+		return nil, err
+	}
+
+	// オーナーを引き継ぎ、最後のメンバーならグループを削除する
+	groupIds, err := getGroupIds(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, groupId := range groupIds {
+		if err := recordGroupActivity(tx, groupId, ActivityMemberLeft, userId, 0, nil); err != nil {
+			return nil, err
+		}
+		if err := leaveGroup(tx, userId, groupId); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Unscoped().Where("user_id = ?", userId).Delete(&Statistics{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("inviter = ? OR invitee = ?", userId, userId).Delete(&Invitation{}).Error; err != nil {
+		return nil, err
+	}
+	for _, model := range []interface{}{
+		&Excusal{},
+		&PushSubscription{},
+		&EmailVerification{},
+		&PasswordResetToken{},
+		&SentMail{},
+		&RecoveryCode{},
+		&PasskeyCredential{},
+		&OidcIdentity{},
+		&ApiToken{},
+		&Profile{},
+		&WakeUpTimeVote{},
+	} {
+		if err := tx.Unscoped().Where("user_id = ?", userId).Delete(model).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// ゲームの記録は他のメンバーのものでもあるので残し、誰のものか分からなくする
+	if err := tx.Model(&GameLog{}).Where("user_id = ?", userId).Update("user_id", 0).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&GameLog{}).Where("target_id = ?", userId).Update("target_id", 0).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&GroupActivity{}).Where("user_id = ?", userId).Update("user_id", 0).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&GroupActivity{}).Where("target_id = ?", userId).Update("target_id", 0).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Model(&AuditLog{}).Where("user_id = ?", userId).Update("user_id", 0).Error; err != nil {
+		return nil, err
+	}
+
+	// 発行した招待コードは使えなくする
+	if err := tx.Model(&GroupInviteCode{}).Where("created_by = ? AND revoked_at IS NULL", userId).Update("revoked_at", time.Now()).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&GroupInviteCode{}).Where("created_by = ?", userId).Update("created_by", 0).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&WakeUpTimeProposal{}).Where("proposed_by = ?", userId).Update("proposed_by", 0).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("kind IN ? AND key = ?", []string{ThrottleKindUser, ThrottleKindResetUser}, user.UserName).Delete(&LoginThrottle{}).Error; err != nil {
+		return nil, err
+	}
+
+	if err := invalidateSessions(tx, userId, ""); err != nil {
+		return nil, err
+	}
+	return groupIds, tx.Unscoped().Delete(&Member{}, userId).Error
+}
+
+// 猶予期間が過ぎたアカウントを削除する
+func purgeDeletedAccounts(app *App, now time.Time) error {
+	var members []Member
+	if err := app.db.Find(&members, "deletion_scheduled_at <= ?", now).Error; err != nil {
+		return err
+	}
+
+	for _, memb := range members {
+		var avatarKey string
+		var groupIds []uint
+		purged := false
+		err := app.db.Transaction(func(tx *gorm.DB) error {
+			// 直前に取り消されていないか確認し直す
+			var user Member
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, memb.ID).Error; err != nil {
+				return err
+			}
+			if user.DeletionScheduledAt == nil || user.DeletionScheduledAt.After(now) {
+				return nil
+			}
+
+			profiles, err := getProfiles(tx, []uint{memb.ID})
+			if err != nil {
+				return err
+			}
+			if profile, ok := profiles[memb.ID]; ok {
+				avatarKey = profile.AvatarKey
+			}
+			groupIds, err = purgeMember(tx, memb.ID)
+			purged = err == nil
+			return err
+		})
+		if err != nil {
+			log.WithField("userId", memb.ID).Error(err)
+			continue
+		}
+		if !purged {
+			continue
+		}
+
+		for _, groupId := range groupIds {
+			app.gameStates.notifyMemberLeft(groupId, memb.ID)
+			go emitGroupEvent(app, groupId, WebhookEventMemberLeft, map[string]interface{}{
+				"userName": memb.UserName,
+			})
+		}
+		if avatarKey != "" && app.blobStore != nil {
+			if err := app.blobStore.Delete(avatarKey); err != nil {
+				log.WithField("userId", memb.ID).Error(err)
+			}
+		}
+		log.WithField("userId", memb.ID).Info("Account deleted")
+	}
+	return nil
+}
+
+func runAccountDeletionScheduler(app *App) {
+	ticker := time.NewTicker(AccountDeletionSchedulerPeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := purgeDeletedAccounts(app, time.Now()); err != nil {
+			log.Error(err)
+		}
+		<-ticker.C
+	}
+}
+
+func handleDeleteAccount(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if reason := confirmIdentity(c, &user, c.PostForm("password")); reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
+		return
+	}
+
+	// グループから抜けるのは猶予期間が過ぎてから (取り消せば元どおりに使える)
+	scheduledAt := time.Now().Add(AccountDeletionGrace)
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Member{}).Where(userId).Update("deletion_scheduled_at", scheduledAt).Error; err != nil {
+			return err
+		}
+		return invalidateSessions(tx, userId, sess.ID())
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"scheduledAt": scheduledAt,
+	})
+}
+
+func handleCancelAccountDeletion(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	if err := app.db.Model(&Member{}).Where(userId).Update("deletion_scheduled_at", nil).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
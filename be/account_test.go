@@ -0,0 +1,151 @@
+package be
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_purgeDeletedAccounts(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	models := []interface{}{
+		&Member{},
+		&Group{},
+		&Statistics{},
+		&Invitation{},
+		&Excusal{},
+		&PushSubscription{},
+		&EmailVerification{},
+		&PasswordResetToken{},
+		&SentMail{},
+		&GameLog{},
+		&MemberSession{},
+		&AuditLog{},
+		&RecoveryCode{},
+		&PasskeyCredential{},
+		&OidcIdentity{},
+		&ApiToken{},
+		&Profile{},
+		&GroupMembership{},
+		&WakeUpTimeVote{},
+		&GroupActivity{},
+		&GroupInviteCode{},
+		&WakeUpTimeProposal{},
+		&LoginThrottle{},
+	}
+	for _, model := range models {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS http_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		key BYTEA,
+		data BYTEA,
+		created_on TIMESTAMPTZ DEFAULT NOW(),
+		modified_on TIMESTAMPTZ,
+		expires_on TIMESTAMPTZ)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		db: db,
+	}
+
+	deletedId, err := registerUser(app, "deleted", "duos^aev6K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remainingId, err := registerUser(app, "remaining", "duos^aev6K")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduledAt := time.Now().Add(-time.Minute)
+	if err := db.Model(&Member{}).Where(deletedId).Update("deletion_scheduled_at", scheduledAt).Error; err != nil {
+		t.Fatal(err)
+	}
+	records := []interface{}{
+		&Statistics{UserId: deletedId, Outcome: OutcomeSuccess, Success: true},
+		&Statistics{UserId: remainingId, Outcome: OutcomeSuccess, Success: true},
+		&Invitation{Inviter: deletedId, Invitee: remainingId},
+		&GameLog{Kind: GameLogKindNudge, UserId: remainingId, TargetId: deletedId},
+		&MemberSession{UserId: deletedId, SessionKey: "DELETEDKEY"},
+		&GroupInviteCode{GroupId: 1, CreatedBy: deletedId, Code: "DELETEDCODE", ExpiresAt: time.Now().Add(time.Hour)},
+		&WakeUpTimeProposal{GroupId: 1, ProposedBy: deletedId, WakeUpTime: "22:00", ExpiresAt: time.Now().Add(time.Hour)},
+		&LoginThrottle{Kind: ThrottleKindUser, Key: "deleted", Failures: 3},
+		&LoginThrottle{Kind: ThrottleKindUser, Key: "remaining", Failures: 3},
+		&Group{Name: "group"},
+		&GroupMembership{UserId: deletedId, GroupId: 1, Role: GroupRoleOwner},
+		&GroupMembership{UserId: remainingId, GroupId: 1, Role: GroupRoleMember},
+	}
+	for _, record := range records {
+		if err := db.Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("INSERT INTO http_sessions (key, data) VALUES (convert_to(?, 'UTF8'), '')", "DELETEDKEY").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := purgeDeletedAccounts(app, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var memberCount, statCount, invitationCount, sessionCount int64
+	db.Unscoped().Model(&Member{}).Count(&memberCount)
+	db.Unscoped().Model(&Statistics{}).Count(&statCount)
+	db.Unscoped().Model(&Invitation{}).Count(&invitationCount)
+	db.Raw("SELECT COUNT(*) FROM http_sessions WHERE key = convert_to(?, 'UTF8')", "DELETEDKEY").Scan(&sessionCount)
+	if memberCount != 1 || statCount != 1 || invitationCount != 0 || sessionCount != 0 {
+		t.Errorf("Data is not deleted: members=%v, stats=%v, invitations=%v, sessions=%v", memberCount, statCount, invitationCount, sessionCount)
+	}
+
+	var entry GameLog
+	if err := db.First(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if entry.UserId != remainingId || entry.TargetId != 0 {
+		t.Errorf("Game log is not anonymized: %+v", entry)
+	}
+
+	var inviteCode GroupInviteCode
+	if err := db.First(&inviteCode).Error; err != nil {
+		t.Fatal(err)
+	}
+	if inviteCode.CreatedBy != 0 || inviteCode.RevokedAt == nil {
+		t.Errorf("Invite code is not revoked: %+v", inviteCode)
+	}
+	var proposal WakeUpTimeProposal
+	if err := db.First(&proposal).Error; err != nil {
+		t.Fatal(err)
+	}
+	if proposal.ProposedBy != 0 {
+		t.Errorf("Proposal is not anonymized: %+v", proposal)
+	}
+	// 削除されるまではグループに残り、削除されたらオーナーを引き継ぐ
+	var memberships []GroupMembership
+	if err := db.Find(&memberships).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 1 || memberships[0].UserId != remainingId || memberships[0].Role != GroupRoleOwner {
+		t.Errorf("Unexpected memberships: %+v", memberships)
+	}
+
+	var throttleCount int64
+	db.Unscoped().Model(&LoginThrottle{}).Where("key = ?", "deleted").Count(&throttleCount)
+	if throttleCount != 0 {
+		t.Errorf("Login throttle is not deleted: %v", throttleCount)
+	}
+
+	for _, model := range models {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package be
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ActivityGroupCreated        = "group_created"
+	ActivityMemberJoined        = "member_joined"
+	ActivityMemberLeft          = "member_left"
+	ActivityMemberRemoved       = "member_removed"
+	ActivityRoleChanged         = "role_changed"
+	ActivityOwnerTransferred    = "owner_transferred"
+	ActivitySettingsChanged     = "settings_changed"
+	ActivityWakeUpTimeProposed  = "wake_up_time_proposed"
+	ActivityWakeUpTimeChanged   = "wake_up_time_changed"
+	ActivityWakeUpTimeRejected  = "wake_up_time_rejected"
+	ActivityWakeUpTimeCancelled = "wake_up_time_cancelled"
+	ActivityGameSucceeded       = "game_succeeded"
+	ActivityGameFailed          = "game_failed"
+	ActivityMemberNudged        = "member_nudged"
+	ActivityStreakMilestone     = "streak_milestone"
+)
+
+const (
+	ActivityPageSize    = 20
+	ActivityMaxPageSize = 100
+)
+
+// グループで起きた出来事の記録 (追記のみ)
+type GroupActivity struct {
+	gorm.Model
+	GroupId uint `gorm:"index"`
+	Kind    string
+	// 操作したメンバーと、操作の対象になったメンバー (いなければ 0)
+	UserId   uint `gorm:"index"`
+	TargetId uint `gorm:"index"`
+	// 出来事ごとの詳細 (JSON)
+	Data string
+}
+
+func recordGroupActivity(tx *gorm.DB, groupId uint, kind string, userId, targetId uint, data map[string]interface{}) error {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&GroupActivity{
+		GroupId:  groupId,
+		Kind:     kind,
+		UserId:   userId,
+		TargetId: targetId,
+		Data:     string(encoded),
+	}).Error
+}
+
+// ゲームの結果を記録する (ハブから呼ばれるので失敗してもログに残すだけにする)
+func recordGameResult(app *App, groupId uint, startTime time.Time, succeeded bool, players int) {
+	date, err := formatStatDate(startTime)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	kind := ActivityGameFailed
+	if succeeded {
+		kind = ActivityGameSucceeded
+	}
+	if err := recordGroupActivity(app.db, groupId, kind, 0, 0, map[string]interface{}{
+		"date":    date,
+		"players": players,
+	}); err != nil {
+		log.Error(err)
+	}
+}
+
+// limit と before (この ID より前の記録を返す) を読み取る
+func parseActivityPage(c *gin.Context) (int, uint, bool) {
+	limit := ActivityPageSize
+	if sLimit := c.Query("limit"); sLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(sLimit)
+		if err != nil || limit <= 0 || limit > ActivityMaxPageSize {
+			return 0, 0, false
+		}
+	}
+	var before uint64
+	if sBefore := c.Query("before"); sBefore != "" {
+		var err error
+		before, err = strconv.ParseUint(sBefore, 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	return limit, uint(before), true
+}
+
+type GroupActivityResp struct {
+	Id         uint                   `json:"id"`
+	Kind       string                 `json:"kind"`
+	UserName   string                 `json:"userName"`
+	TargetName string                 `json:"targetName"`
+	Data       map[string]interface{} `json:"data"`
+	CreatedAt  time.Time              `json:"createdAt"`
+}
+
+type GroupActivityPageResp struct {
+	Activities []GroupActivityResp `json:"activities"`
+	// 次のページを取得するときに before に指定する (最後のページなら null)
+	NextCursor *uint `json:"nextCursor"`
+}
+
+func handleGetGroupActivity(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	limit, before, ok := parseActivityPage(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// 次のページがあるか分かるように 1 件多く取得する
+	query := app.db.Where("group_id = ?", groupId).Order("id desc").Limit(limit + 1)
+	if before != 0 {
+		query = query.Where("id < ?", before)
+	}
+	var activities []GroupActivity
+	if err := query.Find(&activities).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := GroupActivityPageResp{
+		Activities: make([]GroupActivityResp, 0),
+	}
+	if len(activities) > limit {
+		activities = activities[:limit]
+		resp.NextCursor = &activities[limit-1].ID
+	}
+
+	// 抜けたメンバーの名前も表示できるように、グループに関係なく取得する
+	userIds := make([]uint, 0)
+	for _, activity := range activities {
+		userIds = append(userIds, activity.UserId, activity.TargetId)
+	}
+	var members []Member
+	if err := app.db.Find(&members, "id IN ?", userIds).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userNames := make(map[uint]string)
+	for _, memb := range members {
+		userNames[memb.ID] = memb.UserName
+	}
+
+	for _, activity := range activities {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(activity.Data), &data); err != nil {
+			log.WithField("activityId", activity.ID).Error(err)
+		}
+		resp.Activities = append(resp.Activities, GroupActivityResp{
+			Id:         activity.ID,
+			Kind:       activity.Kind,
+			UserName:   userNames[activity.UserId],
+			TargetName: userNames[activity.TargetId],
+			Data:       data,
+			CreatedAt:  activity.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,66 @@
+package be
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_parseActivityPage(t *testing.T) {
+	testcases := []struct {
+		query  string
+		ok     bool
+		limit  int
+		before uint
+	}{
+		{query: "", ok: true, limit: ActivityPageSize, before: 0},
+		{query: "limit=5&before=42", ok: true, limit: 5, before: 42},
+		{query: "limit=0", ok: false},
+		{query: "limit=101", ok: false},
+		{query: "before=-1", ok: false},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, testcase := range testcases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/groups/activity?"+testcase.query, nil)
+
+		limit, before, ok := parseActivityPage(c)
+		if ok != testcase.ok || (ok && (limit != testcase.limit || before != testcase.before)) {
+			t.Errorf("Unexpected result for %q: expected=(%v, %v, %v), actual=(%v, %v, %v)\n", testcase.query, testcase.limit, testcase.before, testcase.ok, limit, before, ok)
+		}
+	}
+}
+
+func Test_recordGroupActivity(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&GroupActivity{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&GroupActivity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recordGroupActivity(db, 1, ActivityRoleChanged, 2, 3, map[string]interface{}{"role": GroupRoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordGroupActivity(db, 1, ActivityMemberLeft, 3, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var activities []GroupActivity
+	if err := db.Order("id").Find(&activities, "group_id = ?", 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 2 {
+		t.Fatalf("Unexpected number of activities: expected=2, actual=%v\n", len(activities))
+	}
+	if activities[0].Data != `{"role":"admin"}` || activities[1].Data != "{}" {
+		t.Errorf("Unexpected data: %v, %v\n", activities[0].Data, activities[1].Data)
+	}
+}
@@ -0,0 +1,309 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgTokenName  = "トークンの名前を入力してください"
+	ErrMsgTokenScope = "トークンの権限を選んでください"
+)
+
+const (
+	ApiTokenScopeRead  = "read"
+	ApiTokenScopeWrite = "write"
+	ApiTokenScopeGame  = "game"
+)
+
+const (
+	ApiTokenPrefix = "oht_"
+	// 最終使用日時の更新はこの間隔より細かくは行わない
+	ApiTokenTouchInterval = time.Minute
+
+	apiTokenContextKey = "api_token"
+)
+
+var apiTokenScopes = []string{ApiTokenScopeRead, ApiTokenScopeWrite, ApiTokenScopeGame}
+
+// トークンで使える API と必要な権限 (ここにないものはトークンでは使えない)
+var apiTokenAllowedRoutes = map[string]string{
+	"GET /users/info":                    ApiTokenScopeRead,
+	"GET /users/find":                    ApiTokenScopeRead,
+	"GET /users/statistics":              ApiTokenScopeRead,
+	"GET /users/statistics/history":      ApiTokenScopeRead,
+	"GET /groups/detail":                 ApiTokenScopeRead,
+	"GET /groups/activity":               ApiTokenScopeRead,
+	"GET /groups/invitations":            ApiTokenScopeRead,
+	"GET /groups/wake_up_time/proposals": ApiTokenScopeRead,
+	"POST /users/excuse":                 ApiTokenScopeWrite,
+	"POST /groups/join":                  ApiTokenScopeWrite,
+	"POST /groups/decline_invitation":    ApiTokenScopeWrite,
+	"POST /groups/wake_up_time":          ApiTokenScopeWrite,
+	"POST /groups/wake_up_time/vote":     ApiTokenScopeWrite,
+	"POST /groups/wake_up_time/cancel":   ApiTokenScopeWrite,
+}
+
+type ApiToken struct {
+	gorm.Model
+	UserId    uint `gorm:"index"`
+	Name      string
+	TokenHash string `gorm:"unique"`
+	// スペース区切り
+	Scopes     string
+	LastUsedAt *time.Time
+}
+
+func (t *ApiToken) hasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// 設定できる権限だけを重複なく並べ直す
+func normalizeApiTokenScopes(scopes []string) string {
+	normalized := make([]string, 0)
+	for _, scope := range apiTokenScopes {
+		for _, s := range scopes {
+			if s == scope {
+				normalized = append(normalized, scope)
+				break
+			}
+		}
+	}
+	return strings.Join(normalized, " ")
+}
+
+// リクエストに必要な権限 (トークンで使えない場合は空)
+func requiredApiTokenScope(method, path string, websocket bool) string {
+	if method == http.MethodGet && path == "/game_ws" {
+		if websocket {
+			return ApiTokenScopeGame
+		}
+		return ""
+	}
+	return apiTokenAllowedRoutes[method+" "+path]
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+func findApiToken(tx *gorm.DB, token string, now time.Time) (*ApiToken, error) {
+	var apiToken ApiToken
+	if err := tx.First(&apiToken, "token_hash = ?", hashToken(token)).Error; err != nil {
+		return nil, err
+	}
+
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > ApiTokenTouchInterval {
+		if err := tx.Model(&ApiToken{}).Where(apiToken.ID).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &apiToken, nil
+}
+
+// パスワードを変えたときにはトークンもすべて使えなくする
+func revokeApiTokens(tx *gorm.DB, userId uint) error {
+	return tx.Where("user_id = ?", userId).Delete(&ApiToken{}).Error
+}
+
+// Authorization ヘッダのトークンを確認する (Origin の確認より前に置く)
+func apiTokenMiddleware(app *App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+
+		apiToken, err := findApiToken(app.db, token, time.Now())
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		scope := requiredApiTokenScope(c.Request.Method, c.Request.URL.Path, c.GetHeader("Upgrade") == "websocket")
+		if scope == "" || !apiToken.hasScope(scope) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Set(apiTokenContextKey, apiToken)
+	}
+}
+
+// トークンで認証したリクエストでは Cookie のセッションの代わりに使う (保存はしない)
+type apiTokenSession struct {
+	values map[interface{}]interface{}
+}
+
+func (s *apiTokenSession) ID() string                                 { return "" }
+func (s *apiTokenSession) Get(key interface{}) interface{}            { return s.values[key] }
+func (s *apiTokenSession) Set(key interface{}, val interface{})       { s.values[key] = val }
+func (s *apiTokenSession) Delete(key interface{})                     { delete(s.values, key) }
+func (s *apiTokenSession) Clear()                                     { s.values = make(map[interface{}]interface{}) }
+func (s *apiTokenSession) AddFlash(value interface{}, vars ...string) {}
+func (s *apiTokenSession) Flashes(vars ...string) []interface{}       { return nil }
+func (s *apiTokenSession) Options(sessions.Options)                   {}
+func (s *apiTokenSession) Save() error                                { return nil }
+
+// セッションのミドルウェアの後に置く
+func apiTokenSessionMiddleware(c *gin.Context) {
+	v, ok := c.Get(apiTokenContextKey)
+	if !ok {
+		return
+	}
+	apiToken := v.(*ApiToken)
+	c.Set(sessions.DefaultKey, &apiTokenSession{
+		values: map[interface{}]interface{}{"user_id": apiToken.UserId},
+	})
+}
+
+func isApiTokenRequest(c *gin.Context) bool {
+	_, ok := c.Get(apiTokenContextKey)
+	return ok
+}
+
+type ApiTokenResp struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+func handleGetApiTokens(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var tokens []ApiToken
+	if err := app.db.Order("created_at").Find(&tokens, "user_id = ?", userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tokensResp := make([]ApiTokenResp, 0)
+	for _, token := range tokens {
+		tokensResp = append(tokensResp, ApiTokenResp{
+			Id:         token.ID,
+			Name:       token.Name,
+			Scopes:     strings.Fields(token.Scopes),
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, tokensResp)
+}
+
+func handleCreateApiToken(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTokenName,
+		})
+		return
+	}
+	scopes := normalizeApiTokenScopes(c.PostFormArray("scope"))
+	if scopes == "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTokenScope,
+		})
+		return
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	token := ApiTokenPrefix + secret
+
+	apiToken := ApiToken{
+		UserId:    userId,
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    scopes,
+	}
+	if err := app.db.Create(&apiToken).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// トークンは平文ではここでしか返さない
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"id":      apiToken.ID,
+		"token":   token,
+	})
+}
+
+func handleRevokeApiToken(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	tokenId, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err := app.db.Where("id = ? AND user_id = ?", tokenId, userId).Delete(&ApiToken{}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,65 @@
+package be
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_requiredApiTokenScope(t *testing.T) {
+	testcases := []struct {
+		name      string
+		method    string
+		path      string
+		websocket bool
+		expected  string
+	}{
+		{"info", http.MethodGet, "/users/info", false, ApiTokenScopeRead},
+		{"join", http.MethodPost, "/groups/join", false, ApiTokenScopeWrite},
+		{"game", http.MethodGet, "/game_ws", true, ApiTokenScopeGame},
+		{"game without upgrade", http.MethodGet, "/game_ws", false, ""},
+		{"create token", http.MethodPost, "/users/tokens", false, ""},
+		{"revoke token", http.MethodPost, "/users/tokens/revoke", false, ""},
+		{"password", http.MethodPost, "/users/password", false, ""},
+		{"password reset", http.MethodPost, "/users/password/reset", false, ""},
+		{"login", http.MethodPost, "/users/login", false, ""},
+		{"transfer", http.MethodPost, "/groups/transfer", false, ""},
+		{"remove member", http.MethodPost, "/groups/members/remove", false, ""},
+		{"webhooks", http.MethodGet, "/groups/webhooks", false, ""},
+		{"add webhook", http.MethodPost, "/groups/webhooks", false, ""},
+		{"avatar", http.MethodPost, "/users/profile/avatar", false, ""},
+		{"unknown path", http.MethodGet, "/users/infofoo", false, ""},
+		{"post to read api", http.MethodPost, "/users/info", false, ""},
+		{"delete method", http.MethodDelete, "/users/info", false, ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := requiredApiTokenScope(tc.method, tc.path, tc.websocket)
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_normalizeApiTokenScopes(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    []string
+		expected string
+	}{
+		{"empty", []string{}, ""},
+		{"ordered", []string{"game", "read"}, "read game"},
+		{"duplicated", []string{"write", "write"}, "write"},
+		{"unknown", []string{"admin", "read"}, "read"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := normalizeApiTokenScopes(tc.input)
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
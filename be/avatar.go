@@ -0,0 +1,99 @@
+package be
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	AvatarMaxBytes = 5 << 20
+	// 展開するとメモリを使いすぎる画像は拒否する (4096 x 4096 の RGBA で 64MB)
+	AvatarMaxDimension = 4096
+	AvatarSize         = 256
+	AvatarQuality      = 85
+)
+
+var ErrAvatarImage = errors.New("invalid avatar image")
+
+// アップロードされた画像を正方形に切り抜いて縮小し、JPEG にし直す (メタデータも消える)
+func processAvatar(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarImage
+	}
+	// 展開する前にヘッダに書かれた大きさを確認する
+	if config.Width <= 0 || config.Height <= 0 || config.Width > AvatarMaxDimension || config.Height > AvatarMaxDimension {
+		return nil, ErrAvatarImage
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarImage
+	}
+
+	// 中央を正方形に切り抜く
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	// 透過部分は白くする
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(square, square.Bounds(), src, image.Pt(x0, y0), draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeSquare(square, AvatarSize), &jpeg.Options{Quality: AvatarQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 正方形の画像を size x size にする (縮小は画素の平均、拡大は最近傍)
+func resizeSquare(src *image.RGBA, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	side := src.Bounds().Dx()
+
+	for dy := 0; dy < size; dy++ {
+		sy0 := dy * side / size
+		sy1 := (dy + 1) * side / size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0 := dx * side / size
+			sx1 := (dx + 1) * side / size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			off := dy*dst.Stride + dx*4
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(b / n)
+			dst.Pix[off+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,104 @@
+package be
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidBlobKey = errors.New("invalid blob key")
+)
+
+// アバター画像などのファイルの保存先 (ローカルディスク以外にも差し替えられるようにする)
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+type diskBlobStore struct {
+	dir string
+}
+
+func newDiskBlobStore(dir string) (*diskBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &diskBlobStore{dir: dir}, nil
+}
+
+// BLOB_DIR が空の場合は data/blobs に保存する
+func newBlobStoreFromEnv() (BlobStore, error) {
+	dir := os.Getenv("BLOB_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "blobs")
+	}
+	return newDiskBlobStore(dir)
+}
+
+// キーをそのままパスに使うので、使える文字を制限する
+func isValidBlobKey(key string) bool {
+	if key == "" || len(key) > 128 || key[0] == '.' {
+		return false
+	}
+	for _, r := range key {
+		if !('a' <= r && r <= 'z') && !('0' <= r && r <= '9') && r != '-' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *diskBlobStore) path(key string) (string, error) {
+	if !isValidBlobKey(key) {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *diskBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// 書き込み途中のファイルを読まれないように、書き終わってから置き換える
+	tmp, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *diskBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *diskBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
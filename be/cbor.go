@@ -0,0 +1,138 @@
+package be
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// WebAuthn で使う範囲の CBOR (RFC 8949) だけを読む
+// 整数は int64、バイト列は []byte、文字列は string、配列は []interface{}、
+// マップは map[interface{}]interface{} (キーは int64 か string) になる
+
+var ErrInvalidCbor = errors.New("invalid cbor")
+
+const cborMaxDepth = 16
+
+func decodeCbor(data []byte) (interface{}, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, ErrInvalidCbor
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, 0, nil, ErrInvalidCbor
+		}
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, 0, nil, ErrInvalidCbor
+		}
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, 0, nil, ErrInvalidCbor
+		}
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, 0, nil, ErrInvalidCbor
+		}
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	// 不定長は使われないので扱わない
+	return 0, 0, nil, ErrInvalidCbor
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, ErrInvalidCbor
+	}
+
+	major, val, rest, err := decodeCborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if val > math.MaxInt64 {
+			return nil, nil, ErrInvalidCbor
+		}
+		return int64(val), rest, nil
+	case 1:
+		if val > math.MaxInt64 {
+			return nil, nil, ErrInvalidCbor
+		}
+		return -1 - int64(val), rest, nil
+	case 2, 3:
+		if val > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		if major == 2 {
+			return append([]byte{}, rest[:val]...), rest[val:], nil
+		}
+		return string(rest[:val]), rest[val:], nil
+	case 4:
+		// 要素は最低 1 バイトなので、残りより多い要素数は不正
+		if val > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		items := make([]interface{}, 0, val)
+		for i := uint64(0); i < val; i++ {
+			var item interface{}
+			item, rest, err = decodeCborItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if val > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		m := make(map[interface{}]interface{}, val)
+		for i := uint64(0); i < val; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCborItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrInvalidCbor
+			}
+			value, rest, err = decodeCborItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case 6:
+		// タグは無視して中身だけを返す
+		return decodeCborItem(rest, depth+1)
+	case 7:
+		switch val {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, ErrInvalidCbor
+}
@@ -0,0 +1,103 @@
+package be
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// CSRF 対策のトークン (Cookie と同じ値をヘッダで送ってもらう)
+const (
+	CsrfCookieName = "csrf_token"
+	CsrfHeaderName = "X-CSRF-Token"
+	// WebSocket ではヘッダを付けられないのでクエリで受け取る
+	CsrfQueryName = "csrf_token"
+)
+
+// ALLOWED_ORIGINS (カンマ区切り) か ALLOWED_ORIGIN で許可する Origin の一覧
+func allowedOrigins() []string {
+	list := os.Getenv("ALLOWED_ORIGINS")
+	if list == "" {
+		list = os.Getenv("ALLOWED_ORIGIN")
+	}
+
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// 最初に書いた Origin をこのアプリの URL として使う
+func primaryOrigin() string {
+	origins := allowedOrigins()
+	if len(origins) == 0 {
+		return ""
+	}
+	return origins[0]
+}
+
+func isAllowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range allowedOrigins() {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// 状態を変えるリクエストと WebSocket の接続で Origin と CSRF トークンを確認する
+func csrfMiddleware(secure bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// トークンで認証したリクエストはブラウザからのものではない
+		if isApiTokenRequest(c) {
+			return
+		}
+
+		cookie, _ := c.Cookie(CsrfCookieName)
+		websocket := strings.EqualFold(c.GetHeader("Upgrade"), "websocket")
+
+		if !isSafeMethod(c.Request.Method) || websocket {
+			if !isAllowedOrigin(c.GetHeader("Origin")) {
+				log.WithField("origin", c.GetHeader("Origin")).Warn("Request from disallowed origin")
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+
+			submitted := c.GetHeader(CsrfHeaderName)
+			if websocket {
+				submitted = c.Query(CsrfQueryName)
+			}
+			if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(submitted)) != 1 {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+
+		if cookie == "" {
+			token, err := generateToken()
+			if err != nil {
+				log.Error(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			// スクリプトから読めるように HttpOnly にはしない
+			c.SetSameSite(http.SameSiteStrictMode)
+			c.SetCookie(CsrfCookieName, token, 0, "/", "", secure, false)
+		}
+	}
+}
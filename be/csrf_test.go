@@ -0,0 +1,114 @@
+package be
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_allowedOrigins(t *testing.T) {
+	defer os.Setenv("ALLOWED_ORIGINS", os.Getenv("ALLOWED_ORIGINS"))
+	defer os.Setenv("ALLOWED_ORIGIN", os.Getenv("ALLOWED_ORIGIN"))
+
+	os.Setenv("ALLOWED_ORIGIN", "http://localhost:8000")
+	os.Setenv("ALLOWED_ORIGINS", "")
+	if origin := primaryOrigin(); origin != "http://localhost:8000" {
+		t.Errorf("Unexpected primary origin: %v", origin)
+	}
+
+	os.Setenv("ALLOWED_ORIGINS", "https://ohatori.example, https://staging.ohatori.example/,capacitor://localhost")
+	testcases := []struct {
+		name     string
+		origin   string
+		expected bool
+	}{
+		{"primary", "https://ohatori.example", true},
+		{"staging", "https://staging.ohatori.example", true},
+		{"native app", "capacitor://localhost", true},
+		{"legacy", "http://localhost:8000", false},
+		{"other", "https://evil.example", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := isAllowedOrigin(tc.origin)
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+	if origin := primaryOrigin(); origin != "https://ohatori.example" {
+		t.Errorf("Unexpected primary origin: %v", origin)
+	}
+}
+
+func Test_csrfMiddleware(t *testing.T) {
+	defer os.Setenv("ALLOWED_ORIGINS", os.Getenv("ALLOWED_ORIGINS"))
+	os.Setenv("ALLOWED_ORIGINS", "https://ohatori.example")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(csrfMiddleware(true))
+	r.GET("/", func(c *gin.Context) {})
+	r.POST("/", func(c *gin.Context) {})
+	r.GET("/game_ws", func(c *gin.Context) {})
+
+	// 最初の GET でトークンの Cookie が設定される
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CsrfCookieName || cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("Unexpected cookies: %v", cookies)
+	}
+	token := cookies[0].Value
+
+	testcases := []struct {
+		name     string
+		method   string
+		path     string
+		origin   string
+		header   string
+		cookie   string
+		upgrade  bool
+		expected int
+	}{
+		{"valid", http.MethodPost, "/", "https://ohatori.example", token, token, false, http.StatusOK},
+		{"no token", http.MethodPost, "/", "https://ohatori.example", "", token, false, http.StatusForbidden},
+		{"wrong token", http.MethodPost, "/", "https://ohatori.example", "wrong", token, false, http.StatusForbidden},
+		{"no cookie", http.MethodPost, "/", "https://ohatori.example", token, "", false, http.StatusForbidden},
+		{"wrong origin", http.MethodPost, "/", "https://evil.example", token, token, false, http.StatusForbidden},
+		{"no origin", http.MethodPost, "/", "", token, token, false, http.StatusForbidden},
+		{"websocket", http.MethodGet, "/game_ws?csrf_token=" + token, "https://ohatori.example", "", token, true, http.StatusOK},
+		{"websocket without token", http.MethodGet, "/game_ws", "https://ohatori.example", "", token, true, http.StatusForbidden},
+		{"websocket wrong origin", http.MethodGet, "/game_ws?csrf_token=" + token, "https://evil.example", "", token, true, http.StatusForbidden},
+		{"get", http.MethodGet, "/", "https://evil.example", "", token, false, http.StatusOK},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.header != "" {
+				req.Header.Set(CsrfHeaderName, tc.header)
+			}
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: tc.cookie})
+			}
+			if tc.upgrade {
+				req.Header.Set("Upgrade", "websocket")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, w.Code)
+			}
+		})
+	}
+}
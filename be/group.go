@@ -1,6 +1,7 @@
 package be
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -10,95 +11,119 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNoGroup       = errors.New("no group")
+	ErrGroupRequired = errors.New("group id is required")
 )
 
 type Group struct {
 	gorm.Model
-	WakeUpTime string `gorm:"default:'22:00'"`
+	Name        string
+	Description string
+	// 参加できる人数の上限
+	MaxMembers int `gorm:"default:10"`
+	// 起床時刻の変更に必要な賛成の割合 (%)
+	ApprovalPercent int    `gorm:"default:51"`
+	WakeUpTime      string `gorm:"default:'22:00'"`
 }
 
-type Invitation struct {
+// メンバーとグループの対応 (1 人のメンバーが複数のグループに所属できる)
+type GroupMembership struct {
 	gorm.Model
-	Inviter uint
-	Invitee uint `gorm:"index"`
-	GroupId uint
+	UserId  uint `gorm:"uniqueIndex:idx_group_membership"`
+	GroupId uint `gorm:"uniqueIndex:idx_group_membership;index"`
+	// owner, admin, member のいずれか
+	Role string `gorm:"default:'member'"`
 }
 
-type InvitationResp struct {
-	Id      uint   `json:"invitationId"`
-	Inviter string `json:"inviter"`
+// 以前は members.group_id に所属するグループを 1 つだけ保存していた
+func migrateGroupMemberships(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Member{}, "group_id") {
+		return nil
+	}
+	if err := db.Exec(`INSERT INTO group_memberships (created_at, updated_at, user_id, group_id)
+		SELECT NOW(), NOW(), id, group_id FROM members WHERE group_id <> 0
+		ON CONFLICT DO NOTHING`).Error; err != nil {
+		return err
+	}
+	return db.Migrator().DropColumn(&Member{}, "group_id")
 }
 
-func handleInvite(app *App, c *gin.Context) {
-	sess := sessions.Default(c)
-	iUserId := sess.Get("user_id")
-	if iUserId == nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	} else if _, ok := iUserId.(uint); !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+// グループに所属するメンバーの ID を返すサブクエリ
+func groupMemberIds(tx *gorm.DB, groupId uint) *gorm.DB {
+	return tx.Model(&GroupMembership{}).Select("user_id").Where("group_id = ?", groupId)
+}
+
+func getGroupMembers(tx *gorm.DB, groupId uint) ([]Member, error) {
+	var members []Member
+	if err := tx.Where("id IN (?)", groupMemberIds(tx, groupId)).Order("id").Find(&members).Error; err != nil {
+		return nil, err
 	}
-	userId := iUserId.(uint)
-	inviteeTag, ok := c.GetPostForm("player")
-	if !ok {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+	return members, nil
+}
+
+// 所属するグループの ID を参加した順に返す
+func getGroupIds(tx *gorm.DB, userId uint) ([]uint, error) {
+	var groupIds []uint
+	if err := tx.Model(&GroupMembership{}).Where("user_id = ?", userId).Order("id").Pluck("group_id", &groupIds).Error; err != nil {
+		return nil, err
 	}
+	return groupIds, nil
+}
 
-	app.db.Transaction(func(tx *gorm.DB) error {
-		var memb Member
-		if err := tx.First(&memb, userId).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return err
-		}
+func isGroupMember(tx *gorm.DB, userId, groupId uint) (bool, error) {
+	var count int64
+	if err := tx.Model(&GroupMembership{}).Where("user_id = ? AND group_id = ?", userId, groupId).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
 
-		var invitee Member
-		if err := tx.First(&invitee, "user_name = ?", inviteeTag).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusBadRequest)
-			return err
-		}
+func addGroupMember(tx *gorm.DB, userId, groupId uint, role string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&GroupMembership{UserId: userId, GroupId: groupId, Role: role}).Error
+}
 
-		groupId := memb.GroupId
-		if memb.GroupId == 0 {
-			// ユーザが何のグループにも所属していないときは新しいグループを作成する
-
-			group := Group{}
-			if err := tx.Create(&group).Error; err != nil {
-				log.Error(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return err
-			}
-			memb.GroupId = group.ID
-			if err := tx.Save(&memb).Error; err != nil {
-				log.Error(err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return err
-			}
-
-			groupId = group.ID
-		}
+func removeGroupMember(tx *gorm.DB, userId, groupId uint) error {
+	return tx.Unscoped().Where("user_id = ? AND group_id = ?", userId, groupId).Delete(&GroupMembership{}).Error
+}
 
-		invitation := Invitation{
-			Inviter: uint(userId),
-			Invitee: invitee.ID,
-			GroupId: groupId,
+// リクエストの groupId で指定されたグループの ID を返す
+// 所属するグループが 1 つだけの場合は省略できる
+func getGroupId(app *App, c *gin.Context, userId uint) (uint, error) {
+	sGroupId := c.Query("groupId")
+	if sGroupId == "" {
+		sGroupId = c.PostForm("groupId")
+	}
+
+	if sGroupId == "" {
+		groupIds, err := getGroupIds(app.db, userId)
+		if err != nil {
+			return 0, err
 		}
-		if err := tx.Create(&invitation).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return err
+		if len(groupIds) == 0 {
+			return 0, ErrNoGroup
+		} else if len(groupIds) > 1 {
+			return 0, ErrGroupRequired
 		}
+		return groupIds[0], nil
+	}
 
-		c.Status(http.StatusCreated)
-
-		return nil
-	})
+	groupId, err := strconv.ParseUint(sGroupId, 10, 32)
+	if err != nil {
+		return 0, ErrNoGroup
+	}
+	if member, err := isGroupMember(app.db, userId, uint(groupId)); err != nil {
+		return 0, err
+	} else if !member {
+		return 0, ErrNoGroup
+	}
+	return uint(groupId), nil
 }
 
-func handleGetInvitations(app *App, c *gin.Context) {
+func handleUnjoin(app *App, c *gin.Context) {
 	sess := sessions.Default(c)
 	iUserId := sess.Get("user_id")
 	if iUserId == nil {
@@ -110,87 +135,48 @@ func handleGetInvitations(app *App, c *gin.Context) {
 	}
 	userId := iUserId.(uint)
 
-	var invitations []Invitation
-	if err := app.db.Find(&invitations, "invitee = ?", userId).Error; err != nil {
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	invitationResp := make([]InvitationResp, 0)
-	for _, inv := range invitations {
-		var inviter Member
-		if err := app.db.First(&inviter, inv.Inviter).Error; err != nil {
-			log.Error(err)
-			continue
-		}
-
-		invitationResp = append(invitationResp, InvitationResp{
-			Id:      inv.ID,
-			Inviter: inviter.UserName,
-		})
-	}
-
-	c.JSON(http.StatusOK, invitationResp)
-}
-
-func handleJoin(app *App, c *gin.Context) {
-	sess := sessions.Default(c)
-	iUserId := sess.Get("user_id")
-	if iUserId == nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	} else if _, ok := iUserId.(uint); !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
 		return
 	}
-	userId := iUserId.(uint)
-	sInvitationId, ok := c.GetPostForm("invitationId")
-	if !ok {
-		c.AbortWithStatus(http.StatusBadRequest)
+	// ゲームの途中で抜けると他のメンバーの手番が崩れるので、終わるまで待ってもらう
+	if app.gameStates.isGameInProgress(groupId) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgLeaveDuringGame,
+		})
 		return
 	}
-	invitationId, err := strconv.ParseUint(sInvitationId, 10, 64)
-	if err != nil {
-		log.Error(err)
-		c.AbortWithStatus(http.StatusBadRequest)
-	}
 
-	app.db.Transaction(func(tx *gorm.DB) error {
-		var user Member
-		if err := tx.First(&user, userId).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return err
-		}
-
-		var invitation Invitation
-		if err := tx.First(&invitation).Where("id = ?", invitationId, "invitee = ?", userId).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusNotAcceptable)
-			return err
-		}
-
-		user.GroupId = invitation.GroupId
-		if err := tx.Save(user).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return err
-		}
-
-		if err := tx.Delete(&invitation).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if err := recordGroupActivity(tx, groupId, ActivityMemberLeft, userId, 0, nil); err != nil {
 			return err
 		}
+		return leaveGroup(tx, userId, groupId)
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
-		c.Status(http.StatusAccepted)
+	// 参加受付中のゲームに接続していれば外す
+	app.gameStates.notifyMemberLeft(groupId, userId)
 
-		return nil
+	go emitGroupEvent(app, groupId, WebhookEventMemberLeft, map[string]interface{}{
+		"userName": user.UserName,
 	})
 }
 
-func handleUnjoin(app *App, c *gin.Context) {
+func handleSetTime(app *App, c *gin.Context) {
 	sess := sessions.Default(c)
 	iUserId := sess.Get("user_id")
 	if iUserId == nil {
@@ -202,43 +188,73 @@ func handleUnjoin(app *App, c *gin.Context) {
 	}
 	userId := iUserId.(uint)
 
-	if err := app.db.Model(&Member{}).Where(userId).Update("group_id", 0).Error; err != nil {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-}
 
-func handleDeclineInvitations(app *App, c *gin.Context) {
-	sess := sessions.Default(c)
-	iUserId := sess.Get("user_id")
-	if iUserId == nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	} else if _, ok := iUserId.(uint); !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-	userId := iUserId.(uint)
-	sInvitationId, ok := c.GetPostForm("invitationId")
-	if !ok {
+	parsedTime, err := time.Parse("15:04", c.PostForm("time"))
+	if err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	invitationId, err := strconv.ParseUint(sInvitationId, 10, 64)
+
+	now := time.Now().In(jst)
+	resultTime := time.Date(now.Year(), now.Month(), now.Day(), parsedTime.Hour(), parsedTime.Minute(), 0, 0, jst).In(time.UTC)
+
+	groupId, err := getGroupId(app, c, userId)
 	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
 		log.Error(err)
-		c.AbortWithStatus(http.StatusBadRequest)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
 
-	if err := app.db.Model(&Invitation{}).Where("invitee = ?", userId).Delete("id = ?", invitationId).Error; err != nil {
+	// 他のメンバーが知らないうちに時刻が変わらないように、変更は提案として扱う
+	var proposal *WakeUpTimeProposal
+	applied := false
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		proposal, applied, err = proposeWakeUpTime(tx, userId, groupId, fmt.Sprintf("%02d:%02d", resultTime.Hour(), resultTime.Minute()), time.Now())
+		return err
+	})
+	if errors.Is(err, ErrProposal) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgProposalExists,
+		})
+		return
+	} else if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+
+	if applied {
+		go emitWakeUpTimeChanged(app, groupId, proposal.WakeUpTime)
+	} else if proposal.Status == ProposalStatusPending {
+		go emitGroupEvent(app, groupId, WebhookEventWakeUpTimeProposed, map[string]interface{}{
+			"userName":   user.UserName,
+			"wakeUpTime": fmt.Sprintf("%02d:%02d", parsedTime.Hour(), parsedTime.Minute()),
+		})
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"proposalId": proposal.ID,
+		"status":     proposal.Status,
+	})
 }
 
-func handleSetTime(app *App, c *gin.Context) {
+// 自分だけが所属する新しいグループを作る
+func handleCreateGroup(app *App, c *gin.Context) {
 	sess := sessions.Default(c)
 	iUserId := sess.Get("user_id")
 	if iUserId == nil {
@@ -250,32 +266,34 @@ func handleSetTime(app *App, c *gin.Context) {
 	}
 	userId := iUserId.(uint)
 
-	jst, err := time.LoadLocation("Asia/Tokyo")
-	if err != nil {
-		log.Error(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+	group := Group{MaxMembers: GroupDefaultMaxMembers, ApprovalPercent: GroupDefaultApprovalPercent}
+	if reason := applyGroupSettings(c, &group, 0); reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
 		return
 	}
 
-	parsedTime, err := time.Parse("15:04", c.PostForm("time"))
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		if err := addGroupMember(tx, userId, group.ID, GroupRoleOwner); err != nil {
+			return err
+		}
+		return recordGroupActivity(tx, group.ID, ActivityGroupCreated, userId, 0, map[string]interface{}{
+			"name": group.Name,
+		})
+	})
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
-	}
-
-	now := time.Now().In(jst)
-	resultTime := time.Date(now.Year(), now.Month(), now.Day(), parsedTime.Hour(), parsedTime.Minute(), 0, 0, jst).In(time.UTC)
-
-	var user Member
-	if err := app.db.First(&user, userId).Error; err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	if err := app.db.Model(&Group{}).Where(user.GroupId).Update("wake_up_time", fmt.Sprintf("%02d:%02d", resultTime.Hour(), resultTime.Minute())).Error; err != nil {
-		log.Error(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
+	c.JSON(http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"groupId": group.ID,
+	})
 }
@@ -0,0 +1,85 @@
+package be
+
+import (
+	"testing"
+)
+
+func Test_groupMembership(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	for _, model := range []interface{}{&Member{}, &Group{}, &GroupMembership{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := &App{
+		db: db,
+	}
+	taroId, err := registerUser(app, "taro", "duos^aev6K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hanakoId, err := registerUser(app, "hanako", "duos^aev6K")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// taro は 2 つのグループに所属する
+	memberships := []GroupMembership{
+		{UserId: taroId, GroupId: 1, Role: GroupRoleOwner},
+		{UserId: taroId, GroupId: 2, Role: GroupRoleOwner},
+		{UserId: hanakoId, GroupId: 2, Role: GroupRoleMember},
+	}
+	for _, membership := range memberships {
+		if err := addGroupMember(db, membership.UserId, membership.GroupId, membership.Role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 回追加しても重複しない
+	if err := addGroupMember(db, taroId, 1, GroupRoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	groupIds, err := getGroupIds(db, taroId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groupIds) != 2 || groupIds[0] != 1 || groupIds[1] != 2 {
+		t.Errorf("Unexpected groups: expected=[1 2], actual=%v\n", groupIds)
+	}
+
+	members, err := getGroupMembers(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Errorf("Unexpected number of members: expected=2, actual=%v\n", len(members))
+	}
+
+	if err := leaveGroup(db, taroId, 2); err != nil {
+		t.Fatal(err)
+	}
+	if member, err := isGroupMember(db, taroId, 2); err != nil {
+		t.Fatal(err)
+	} else if member {
+		t.Errorf("Member is not removed from the group\n")
+	}
+	if member, err := isGroupMember(db, taroId, 1); err != nil {
+		t.Fatal(err)
+	} else if !member {
+		t.Errorf("Member is removed from another group\n")
+	}
+
+	// オーナーが抜けたので残ったメンバーがオーナーになる
+	if role, err := getGroupRole(db, hanakoId, 2); err != nil {
+		t.Fatal(err)
+	} else if role != GroupRoleOwner {
+		t.Errorf("Unexpected role after the owner left: expected=%v, actual=%v\n", GroupRoleOwner, role)
+	}
+}
@@ -0,0 +1,294 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgGroupMember = "そのメンバーはグループにいません"
+	ErrMsgGroupOwner  = "オーナーは外せません。先にオーナーを譲ってください"
+	ErrMsgGroupRole   = "権限の種類が正しくありません"
+)
+
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+// 設定の変更やメンバーを外すことができる権限
+func isGroupAdminRole(role string) bool {
+	return role == GroupRoleOwner || role == GroupRoleAdmin
+}
+
+// グループに所属していなければ空文字列を返す
+func getGroupRole(tx *gorm.DB, userId, groupId uint) (string, error) {
+	var membership GroupMembership
+	err := tx.First(&membership, "user_id = ? AND group_id = ?", userId, groupId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return membership.Role, nil
+}
+
+func setGroupRole(tx *gorm.DB, userId, groupId uint, role string) error {
+	return tx.Model(&GroupMembership{}).Where("user_id = ? AND group_id = ?", userId, groupId).Update("role", role).Error
+}
+
+func findGroupMember(tx *gorm.DB, groupId uint, userName string) (*Member, error) {
+	var member Member
+	if err := tx.Where("id IN (?)", groupMemberIds(tx, groupId)).First(&member, "user_name = ?", userName).Error; err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// オーナーがいなければ、管理者、メンバーの順に参加が早い人をオーナーにする
+func ensureGroupOwner(tx *gorm.DB, groupId uint) error {
+	var count int64
+	if err := tx.Model(&GroupMembership{}).Where("group_id = ? AND role = ?", groupId, GroupRoleOwner).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != 0 {
+		return nil
+	}
+
+	var next GroupMembership
+	err := tx.Where("group_id = ?", groupId).Order(gorm.Expr("CASE role WHEN ? THEN 0 ELSE 1 END, id", GroupRoleAdmin)).First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return tx.Model(&next).Update("role", GroupRoleOwner).Error
+}
+
+// 権限を導入する前のグループにオーナーを決める
+func migrateGroupOwners(db *gorm.DB) error {
+	var groupIds []uint
+	if err := db.Model(&GroupMembership{}).Distinct("group_id").Pluck("group_id", &groupIds).Error; err != nil {
+		return err
+	}
+	for _, groupId := range groupIds {
+		if err := ensureGroupOwner(db, groupId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// グループから抜ける (オーナーが抜けた場合は他のメンバーがオーナーになる)
+// 最後のメンバーが抜けたグループは削除する
+func leaveGroup(tx *gorm.DB, userId, groupId uint) error {
+	if err := removeGroupMember(tx, userId, groupId); err != nil {
+		return err
+	}
+	if deleted, err := deleteGroupIfEmpty(tx, groupId); err != nil || deleted {
+		return err
+	}
+	return ensureGroupOwner(tx, groupId)
+}
+
+// 他のメンバーに対する操作の対象
+type groupMemberOperation struct {
+	groupId    uint
+	role       string
+	target     *Member
+	targetRole string
+}
+
+// 操作するユーザーのグループと権限を確認し、対象のメンバーを探す
+// 失敗した場合はレスポンスを書き込んで nil を返す
+func prepareGroupMemberOperation(app *App, c *gin.Context, userId uint, ownerOnly bool) *groupMemberOperation {
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return nil
+	}
+
+	role, err := getGroupRole(app.db, userId, groupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+	if !isGroupAdminRole(role) || (ownerOnly && role != GroupRoleOwner) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return nil
+	}
+
+	target, err := findGroupMember(app.db, groupId, c.PostForm("userName"))
+	if err != nil || target.ID == userId {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgGroupMember,
+		})
+		return nil
+	}
+
+	targetRole, err := getGroupRole(app.db, target.ID, groupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	return &groupMemberOperation{
+		groupId:    groupId,
+		role:       role,
+		target:     target,
+		targetRole: targetRole,
+	}
+}
+
+func handleRemoveGroupMember(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	op := prepareGroupMemberOperation(app, c, userId, false)
+	if op == nil {
+		return
+	}
+
+	if op.targetRole == GroupRoleOwner {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgGroupOwner,
+		})
+		return
+	}
+	// 管理者を外せるのはオーナーだけ
+	if op.targetRole == GroupRoleAdmin && op.role != GroupRoleOwner {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if app.gameStates.isGameInProgress(op.groupId) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgLeaveDuringGame,
+		})
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := recordGroupActivity(tx, op.groupId, ActivityMemberRemoved, userId, op.target.ID, nil); err != nil {
+			return err
+		}
+		return leaveGroup(tx, op.target.ID, op.groupId)
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	app.gameStates.notifyMemberLeft(op.groupId, op.target.ID)
+
+	go emitGroupEvent(app, op.groupId, WebhookEventMemberLeft, map[string]interface{}{
+		"userName": op.target.UserName,
+	})
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// オーナーが管理者を任命したり外したりする
+func handleSetGroupRole(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	role := c.PostForm("role")
+	if role != GroupRoleAdmin && role != GroupRoleMember {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgGroupRole,
+		})
+		return
+	}
+
+	op := prepareGroupMemberOperation(app, c, userId, true)
+	if op == nil {
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := setGroupRole(tx, op.target.ID, op.groupId, role); err != nil {
+			return err
+		}
+		return recordGroupActivity(tx, op.groupId, ActivityRoleChanged, userId, op.target.ID, map[string]interface{}{
+			"role": role,
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// オーナーを他のメンバーに譲る (元のオーナーは管理者になる)
+func handleTransferGroupOwnership(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	op := prepareGroupMemberOperation(app, c, userId, true)
+	if op == nil {
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := setGroupRole(tx, userId, op.groupId, GroupRoleAdmin); err != nil {
+			return err
+		}
+		if err := setGroupRole(tx, op.target.ID, op.groupId, GroupRoleOwner); err != nil {
+			return err
+		}
+		return recordGroupActivity(tx, op.groupId, ActivityOwnerTransferred, userId, op.target.ID, nil)
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
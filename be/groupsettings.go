@@ -0,0 +1,310 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgGroupName        = "グループ名は30文字以内で入力してください"
+	ErrMsgGroupDescription = "グループの説明は200文字以内で入力してください"
+	ErrMsgGroupMaxMembers  = "人数の上限は2人から20人までで、今のメンバーの数以上にしてください"
+	ErrMsgGroupFull        = "グループの人数が上限に達しています"
+	ErrMsgApprovalPercent  = "賛成の割合は51%から100%までにしてください"
+)
+
+const (
+	GroupNameMaxLength        = 30
+	GroupDescriptionMaxLength = 200
+	GroupDefaultMaxMembers    = 10
+	GroupMaxMembersLowerLimit = 2
+	GroupMaxMembersUpperLimit = 20
+	// 過半数
+	GroupDefaultApprovalPercent = 51
+)
+
+var ErrGroupFull = errors.New("group is full")
+
+func isValidGroupName(name string) bool {
+	return utf8.RuneCountInString(name) <= GroupNameMaxLength && isDisplayableText(name, false)
+}
+
+func isValidGroupDescription(description string) bool {
+	return utf8.RuneCountInString(description) <= GroupDescriptionMaxLength && isDisplayableText(description, true)
+}
+
+// フォームで指定された項目だけを group に反映する
+// 不正な値があればその理由を返す
+func applyGroupSettings(c *gin.Context, group *Group, memberCount int) string {
+	if name, ok := c.GetPostForm("name"); ok {
+		name = strings.TrimSpace(name)
+		if !isValidGroupName(name) {
+			return ErrMsgGroupName
+		}
+		group.Name = name
+	}
+	if description, ok := c.GetPostForm("description"); ok {
+		description = strings.TrimSpace(strings.ReplaceAll(description, "\r\n", "\n"))
+		if !isValidGroupDescription(description) {
+			return ErrMsgGroupDescription
+		}
+		group.Description = description
+	}
+	if sMaxMembers, ok := c.GetPostForm("maxMembers"); ok {
+		maxMembers, err := strconv.Atoi(sMaxMembers)
+		if err != nil || maxMembers < GroupMaxMembersLowerLimit || maxMembers > GroupMaxMembersUpperLimit || maxMembers < memberCount {
+			return ErrMsgGroupMaxMembers
+		}
+		group.MaxMembers = maxMembers
+	}
+	if sPercent, ok := c.GetPostForm("approvalPercent"); ok {
+		percent, err := strconv.Atoi(sPercent)
+		if err != nil || percent < GroupDefaultApprovalPercent || percent > 100 {
+			return ErrMsgApprovalPercent
+		}
+		group.ApprovalPercent = percent
+	}
+	return ""
+}
+
+func countGroupMembers(tx *gorm.DB, groupId uint) (int, error) {
+	var count int64
+	if err := tx.Model(&GroupMembership{}).Where("group_id = ?", groupId).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// 新しいメンバーを追加できるか確認する
+// 同時に参加して上限を超えないように、グループの行をロックする
+func checkGroupCapacity(tx *gorm.DB, groupId uint) error {
+	var group Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, groupId).Error; err != nil {
+		return err
+	}
+	count, err := countGroupMembers(tx, groupId)
+	if err != nil {
+		return err
+	}
+	if count >= group.MaxMembers {
+		return ErrGroupFull
+	}
+	return nil
+}
+
+// グループと、そのグループへの招待や通知先などをまとめて削除する
+func deleteGroup(tx *gorm.DB, groupId uint) error {
+	if err := tx.Unscoped().Where("group_id = ?", groupId).Delete(&Invitation{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("group_id = ?", groupId).Delete(&GroupInviteCode{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("group_id = ?", groupId).Delete(&GroupActivity{}).Error; err != nil {
+		return err
+	}
+	proposalIds := tx.Unscoped().Model(&WakeUpTimeProposal{}).Select("id").Where("group_id = ?", groupId)
+	if err := tx.Unscoped().Where("proposal_id IN (?)", proposalIds).Delete(&WakeUpTimeVote{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("group_id = ?", groupId).Delete(&WakeUpTimeProposal{}).Error; err != nil {
+		return err
+	}
+	webhookIds := tx.Unscoped().Model(&Webhook{}).Select("id").Where("group_id = ?", groupId)
+	if err := tx.Unscoped().Where("webhook_id IN (?)", webhookIds).Delete(&WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("group_id = ?", groupId).Delete(&Webhook{}).Error; err != nil {
+		return err
+	}
+	// 統計やゲームの記録は残す
+	return tx.Unscoped().Delete(&Group{}, groupId).Error
+}
+
+// 同時に参加しようとしているメンバーを数え漏らさないように、参加の処理 (checkGroupCapacity) と同じくグループをロックしてから数える
+func deleteGroupIfEmpty(tx *gorm.DB, groupId uint) (bool, error) {
+	var group Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, groupId).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	count, err := countGroupMembers(tx, groupId)
+	if err != nil {
+		return false, err
+	}
+	if count != 0 {
+		return false, nil
+	}
+	return true, deleteGroup(tx, groupId)
+}
+
+// 以前は最後のメンバーが抜けてもグループが残っていた
+func cleanupEmptyGroups(db *gorm.DB) error {
+	var groupIds []uint
+	if err := db.Model(&Group{}).Where("id NOT IN (?)", db.Model(&GroupMembership{}).Select("group_id")).Pluck("id", &groupIds).Error; err != nil {
+		return err
+	}
+	for _, groupId := range groupIds {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := deleteGroupIfEmpty(tx, groupId)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type GroupDetailResp struct {
+	Id              uint      `json:"id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	MaxMembers      int       `json:"maxMembers"`
+	MemberCount     int       `json:"memberCount"`
+	ApprovalPercent int       `json:"approvalPercent"`
+	WakeUpTime      string    `json:"wakeUpTime"`
+	CreatedAt       time.Time `json:"createdAt"`
+	// 自分の権限
+	Role string `json:"role"`
+}
+
+func handleGetGroup(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	var group Group
+	if err := app.db.First(&group, groupId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	memberCount, err := countGroupMembers(app.db, groupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	role, err := getGroupRole(app.db, userId, groupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	wakeUpTime, err := localWakeUpTime(group.WakeUpTime)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, GroupDetailResp{
+		Id:              group.ID,
+		Name:            group.Name,
+		Description:     group.Description,
+		MaxMembers:      group.MaxMembers,
+		MemberCount:     memberCount,
+		ApprovalPercent: group.ApprovalPercent,
+		WakeUpTime:      wakeUpTime,
+		CreatedAt:       group.CreatedAt,
+		Role:            role,
+	})
+}
+
+// 名前、説明、人数の上限、提案の可決に必要な割合を変更する (管理者のみ)
+func handleUpdateGroup(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	if role, err := getGroupRole(app.db, userId, groupId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	} else if !isGroupAdminRole(role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	reason := ""
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		var group Group
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, groupId).Error; err != nil {
+			return err
+		}
+		memberCount, err := countGroupMembers(tx, groupId)
+		if err != nil {
+			return err
+		}
+		if reason = applyGroupSettings(c, &group, memberCount); reason != "" {
+			return nil
+		}
+		if err := tx.Model(&group).Updates(map[string]interface{}{
+			"name":             group.Name,
+			"description":      group.Description,
+			"max_members":      group.MaxMembers,
+			"approval_percent": group.ApprovalPercent,
+		}).Error; err != nil {
+			return err
+		}
+		return recordGroupActivity(tx, groupId, ActivitySettingsChanged, userId, 0, map[string]interface{}{
+			"name":            group.Name,
+			"description":     group.Description,
+			"maxMembers":      group.MaxMembers,
+			"approvalPercent": group.ApprovalPercent,
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,128 @@
+package be
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_applyGroupSettings(t *testing.T) {
+	testcases := []struct {
+		name        string
+		form        url.Values
+		memberCount int
+		reason      string
+		result      Group
+	}{
+		{
+			name:   "empty form",
+			form:   url.Values{},
+			result: Group{Name: "old", MaxMembers: GroupDefaultMaxMembers},
+		},
+		{
+			name:   "all fields",
+			form:   url.Values{"name": {" 早起き部 "}, "description": {"毎朝6時\r\nよろしく"}, "maxMembers": {"5"}},
+			result: Group{Name: "早起き部", Description: "毎朝6時\nよろしく", MaxMembers: 5},
+		},
+		{
+			name:   "long name",
+			form:   url.Values{"name": {strings.Repeat("あ", GroupNameMaxLength+1)}},
+			reason: ErrMsgGroupName,
+		},
+		{
+			name:   "control character in description",
+			form:   url.Values{"description": {"a\u202eb"}},
+			reason: ErrMsgGroupDescription,
+		},
+		{
+			name:   "too many members",
+			form:   url.Values{"maxMembers": {"21"}},
+			reason: ErrMsgGroupMaxMembers,
+		},
+		{
+			name:        "fewer than current members",
+			form:        url.Values{"maxMembers": {"3"}},
+			memberCount: 4,
+			reason:      ErrMsgGroupMaxMembers,
+		},
+		{
+			name:   "not a number",
+			form:   url.Values{"maxMembers": {"many"}},
+			reason: ErrMsgGroupMaxMembers,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, testcase := range testcases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/groups/update", strings.NewReader(testcase.form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		group := Group{Name: "old", MaxMembers: GroupDefaultMaxMembers}
+		reason := applyGroupSettings(c, &group, testcase.memberCount)
+		if reason != testcase.reason {
+			t.Errorf("Unexpected reason for %s: expected=%v, actual=%v\n", testcase.name, testcase.reason, reason)
+			continue
+		}
+		if reason == "" && group != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%+v, actual=%+v\n", testcase.name, testcase.result, group)
+		}
+	}
+}
+
+func Test_groupLifecycle(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	for _, model := range []interface{}{&Member{}, &Group{}, &GroupMembership{}, &Invitation{}, &GroupInviteCode{}, &GroupActivity{}, &WakeUpTimeProposal{}, &WakeUpTimeVote{}, &Webhook{}, &WebhookDelivery{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	group := Group{Name: "test", MaxMembers: 2}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	for userId := uint(1); userId <= 2; userId++ {
+		if err := checkGroupCapacity(db, group.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := addGroupMember(db, userId, group.ID, GroupRoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkGroupCapacity(db, group.ID); err != ErrGroupFull {
+		t.Errorf("Unexpected result for a full group: expected=%v, actual=%v\n", ErrGroupFull, err)
+	}
+
+	if err := db.Create(&Invitation{Inviter: 1, Invitee: 3, GroupId: group.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Webhook{GroupId: group.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for userId := uint(1); userId <= 2; userId++ {
+		if err := leaveGroup(db, userId, group.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 最後のメンバーが抜けたらグループごと削除される
+	var groupCount, invitationCount, webhookCount int64
+	db.Unscoped().Model(&Group{}).Count(&groupCount)
+	db.Unscoped().Model(&Invitation{}).Count(&invitationCount)
+	db.Unscoped().Model(&Webhook{}).Count(&webhookCount)
+	if groupCount != 0 || invitationCount != 0 || webhookCount != 0 {
+		t.Errorf("Group is not deleted: groups=%v, invitations=%v, webhooks=%v\n", groupCount, invitationCount, webhookCount)
+	}
+}
@@ -0,0 +1,543 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgInvitation       = "招待が見つからないか、有効期限が切れています"
+	ErrMsgInvitationExists = "そのユーザーは既に招待しています"
+	ErrMsgInviteeJoined    = "そのユーザーは既にグループに参加しています"
+	ErrMsgInviteSelf       = "自分自身は招待できません"
+)
+
+const (
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusDeclined = "declined"
+	InvitationStatusRevoked  = "revoked"
+	InvitationStatusExpired  = "expired"
+)
+
+const (
+	InvitationTTL         = 14 * 24 * time.Hour
+	InvitationSweepPeriod = time.Hour
+	// 送った招待の一覧に表示する件数
+	SentInvitationsLimit = 50
+)
+
+var (
+	ErrInvitation          = errors.New("invitation not found")
+	ErrInvitationForbidden = errors.New("not allowed to revoke the invitation")
+)
+
+type Invitation struct {
+	gorm.Model
+	Inviter   uint `gorm:"index"`
+	Invitee   uint `gorm:"index"`
+	GroupId   uint
+	Status    string `gorm:"default:'pending'"`
+	ExpiresAt time.Time
+	// 承諾・辞退・取り消し・期限切れになった日時
+	RespondedAt *time.Time
+}
+
+// 期限が過ぎていてもまだ処理されていなければ pending のままなので、期限切れとして扱う
+func (inv *Invitation) currentStatus(now time.Time) string {
+	if inv.Status == InvitationStatusPending && !now.Before(inv.ExpiresAt) {
+		return InvitationStatusExpired
+	}
+	return inv.Status
+}
+
+func migrateInvitations(db *gorm.DB) error {
+	// 有効期限を導入する前の招待
+	if err := db.Exec("UPDATE invitations SET expires_at = created_at + ? * INTERVAL '1 second' WHERE expires_at IS NULL", int64(InvitationTTL/time.Second)).Error; err != nil {
+		return err
+	}
+	// 同じグループへの保留中の招待は 1 人に 1 つまで (古いものが重複していれば最初のもの以外を取り消す)
+	if err := db.Exec(`UPDATE invitations SET status = ? WHERE status = ? AND deleted_at IS NULL AND id NOT IN (
+		SELECT MIN(id) FROM invitations WHERE status = ? AND deleted_at IS NULL GROUP BY invitee, group_id)`,
+		InvitationStatusRevoked, InvitationStatusPending, InvitationStatusPending).Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_invitation_pending ON invitations (invitee, group_id) WHERE status = 'pending' AND deleted_at IS NULL").Error
+}
+
+func setInvitationStatus(query *gorm.DB, status string, now time.Time) *gorm.DB {
+	return query.Updates(map[string]interface{}{
+		"status":       status,
+		"responded_at": now,
+	})
+}
+
+// 期限が過ぎた招待を期限切れにする
+func expireInvitations(tx *gorm.DB, now time.Time) (int64, error) {
+	query := tx.Model(&Invitation{}).Where("status = ? AND expires_at <= ?", InvitationStatusPending, now)
+	result := setInvitationStatus(query, InvitationStatusExpired, now)
+	return result.RowsAffected, result.Error
+}
+
+func runInvitationSweeper(app *App) {
+	ticker := time.NewTicker(InvitationSweepPeriod)
+	defer ticker.Stop()
+
+	for {
+		if n, err := expireInvitations(app.db, time.Now()); err != nil {
+			log.Error(err)
+		} else if n != 0 {
+			log.WithField("count", n).Info("Invitations expired")
+		}
+		<-ticker.C
+	}
+}
+
+// 自分宛てのまだ応答できる招待を取得する (行をロックする)
+func findPendingInvitation(tx *gorm.DB, invitationId uint64, userId uint, now time.Time) (*Invitation, error) {
+	var invitation Invitation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invitation, "id = ? AND invitee = ?", invitationId, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvitation
+	} else if err != nil {
+		return nil, err
+	}
+	if invitation.currentStatus(now) != InvitationStatusPending {
+		return nil, ErrInvitation
+	}
+	return &invitation, nil
+}
+
+type InvitationResp struct {
+	Id        uint      `json:"invitationId"`
+	Inviter   string    `json:"inviter"`
+	GroupId   uint      `json:"groupId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type SentInvitationResp struct {
+	Id        uint      `json:"invitationId"`
+	Invitee   string    `json:"invitee"`
+	GroupId   uint      `json:"groupId"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func handleInvite(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+	inviteeTag, ok := c.GetPostForm("player")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	var inviter, invitee Member
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		var memb Member
+		if err := tx.First(&memb, userId).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		}
+
+		if err := tx.First(&invitee, "user_name = ?", inviteeTag).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return err
+		}
+		if invitee.ID == userId {
+			c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+				"success": false,
+				"reason":  ErrMsgInviteSelf,
+			})
+			return ErrInvitation
+		}
+
+		groupId, err := getGroupId(app, c, userId)
+		if errors.Is(err, ErrNoGroup) && c.PostForm("groupId") == "" {
+			// ユーザが何のグループにも所属していないときは新しいグループを作成する
+			group := Group{}
+			if err := tx.Create(&group).Error; err != nil {
+				log.Error(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return err
+			}
+			if err := addGroupMember(tx, userId, group.ID, GroupRoleOwner); err != nil {
+				log.Error(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return err
+			}
+			if err := recordGroupActivity(tx, group.ID, ActivityGroupCreated, userId, 0, nil); err != nil {
+				log.Error(err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return err
+			}
+
+			groupId = group.ID
+		} else if err != nil {
+			c.AbortWithStatus(http.StatusNotAcceptable)
+			return err
+		}
+
+		if joined, err := isGroupMember(tx, invitee.ID, groupId); err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		} else if joined {
+			c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+				"success": false,
+				"reason":  ErrMsgInviteeJoined,
+			})
+			return ErrInvitation
+		}
+
+		if err := checkGroupCapacity(tx, groupId); errors.Is(err, ErrGroupFull) {
+			c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+				"success": false,
+				"reason":  ErrMsgGroupFull,
+			})
+			return err
+		} else if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		}
+
+		// 期限が過ぎた招待が残っていれば新しく招待できるようにする
+		stale := tx.Model(&Invitation{}).Where("invitee = ? AND group_id = ? AND status = ? AND expires_at <= ?", invitee.ID, groupId, InvitationStatusPending, now)
+		if err := setInvitationStatus(stale, InvitationStatusExpired, now).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		}
+		var pending int64
+		if err := tx.Model(&Invitation{}).Where("invitee = ? AND group_id = ? AND status = ?", invitee.ID, groupId, InvitationStatusPending).Count(&pending).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		} else if pending != 0 {
+			c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+				"success": false,
+				"reason":  ErrMsgInvitationExists,
+			})
+			return ErrInvitation
+		}
+
+		invitation := Invitation{
+			Inviter:   userId,
+			Invitee:   invitee.ID,
+			GroupId:   groupId,
+			Status:    InvitationStatusPending,
+			ExpiresAt: now.Add(InvitationTTL),
+		}
+		if err := tx.Create(&invitation).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return err
+		}
+
+		c.Status(http.StatusCreated)
+
+		inviter = memb
+		return nil
+	})
+	if err == nil {
+		go sendInvitationMail(app, &invitee, &inviter)
+	}
+}
+
+func handleGetInvitations(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var invitations []Invitation
+	if err := app.db.Order("created_at").Find(&invitations, "invitee = ? AND status = ? AND expires_at > ?", userId, InvitationStatusPending, time.Now()).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	invitationResp := make([]InvitationResp, 0)
+	for _, inv := range invitations {
+		var inviter Member
+		if err := app.db.First(&inviter, inv.Inviter).Error; err != nil {
+			log.Error(err)
+			continue
+		}
+
+		invitationResp = append(invitationResp, InvitationResp{
+			Id:        inv.ID,
+			Inviter:   inviter.UserName,
+			GroupId:   inv.GroupId,
+			ExpiresAt: inv.ExpiresAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, invitationResp)
+}
+
+// 自分が送った招待の一覧 (新しい順)
+func handleGetSentInvitations(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var invitations []Invitation
+	if err := app.db.Order("created_at desc").Limit(SentInvitationsLimit).Find(&invitations, "inviter = ?", userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	invitationResp := make([]SentInvitationResp, 0)
+	for _, inv := range invitations {
+		var invitee Member
+		if err := app.db.First(&invitee, inv.Invitee).Error; err != nil {
+			log.Error(err)
+			continue
+		}
+
+		invitationResp = append(invitationResp, SentInvitationResp{
+			Id:        inv.ID,
+			Invitee:   invitee.UserName,
+			GroupId:   inv.GroupId,
+			Status:    inv.currentStatus(now),
+			CreatedAt: inv.CreatedAt,
+			ExpiresAt: inv.ExpiresAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, invitationResp)
+}
+
+func handleJoin(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+	sInvitationId, ok := c.GetPostForm("invitationId")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	invitationId, err := strconv.ParseUint(sInvitationId, 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	var joined Member
+	var joinedGroupId uint
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&joined, userId).Error; err != nil {
+			return err
+		}
+
+		invitation, err := findPendingInvitation(tx, invitationId, userId, now)
+		if err != nil {
+			return err
+		}
+		// 招待コードなどで既に参加している場合
+		if joined, err := isGroupMember(tx, userId, invitation.GroupId); err != nil {
+			return err
+		} else if joined {
+			return ErrGroupAlreadyJoined
+		}
+
+		if err := checkGroupCapacity(tx, invitation.GroupId); err != nil {
+			return err
+		}
+		if err := addGroupMember(tx, userId, invitation.GroupId, GroupRoleMember); err != nil {
+			return err
+		}
+		if err := setInvitationStatus(tx.Model(invitation), InvitationStatusAccepted, now).Error; err != nil {
+			return err
+		}
+		if err := recordGroupActivity(tx, invitation.GroupId, ActivityMemberJoined, userId, invitation.Inviter, map[string]interface{}{
+			"via": "invitation",
+		}); err != nil {
+			return err
+		}
+
+		joinedGroupId = invitation.GroupId
+		return nil
+	})
+	if errors.Is(err, ErrInvitation) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgInvitation,
+		})
+		return
+	} else if errors.Is(err, ErrGroupAlreadyJoined) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgAlreadyJoined,
+		})
+		return
+	} else if errors.Is(err, ErrGroupFull) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgGroupFull,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+
+	go emitGroupEvent(app, joinedGroupId, WebhookEventMemberJoined, map[string]interface{}{
+		"userName": joined.UserName,
+	})
+}
+
+func handleDeclineInvitations(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+	sInvitationId, ok := c.GetPostForm("invitationId")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	invitationId, err := strconv.ParseUint(sInvitationId, 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		invitation, err := findPendingInvitation(tx, invitationId, userId, now)
+		if err != nil {
+			return err
+		}
+		return setInvitationStatus(tx.Model(invitation), InvitationStatusDeclined, now).Error
+	})
+	if errors.Is(err, ErrInvitation) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgInvitation,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
+
+// 招待した本人かグループの管理者が、まだ応答されていない招待を取り消す
+func handleRevokeInvitation(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+	invitationId, err := strconv.ParseUint(c.PostForm("invitationId"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		var invitation Invitation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invitation, invitationId).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvitation
+		} else if err != nil {
+			return err
+		}
+
+		if invitation.Inviter != userId {
+			role, err := getGroupRole(tx, userId, invitation.GroupId)
+			if err != nil {
+				return err
+			}
+			if role == "" {
+				return ErrInvitation
+			} else if !isGroupAdminRole(role) {
+				return ErrInvitationForbidden
+			}
+		}
+		if invitation.currentStatus(now) != InvitationStatusPending {
+			return ErrInvitation
+		}
+
+		return setInvitationStatus(tx.Model(&invitation), InvitationStatusRevoked, now).Error
+	})
+	if errors.Is(err, ErrInvitationForbidden) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrInvitation) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgInvitation,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
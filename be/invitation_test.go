@@ -0,0 +1,133 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_invitationCurrentStatus(t *testing.T) {
+	now := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		name      string
+		status    string
+		expiresAt time.Time
+		result    string
+	}{
+		{name: "pending", status: InvitationStatusPending, expiresAt: now.Add(time.Hour), result: InvitationStatusPending},
+		{name: "pending but expired", status: InvitationStatusPending, expiresAt: now, result: InvitationStatusExpired},
+		{name: "accepted", status: InvitationStatusAccepted, expiresAt: now.Add(-time.Hour), result: InvitationStatusAccepted},
+		{name: "revoked", status: InvitationStatusRevoked, expiresAt: now.Add(time.Hour), result: InvitationStatusRevoked},
+	}
+	for _, testcase := range testcases {
+		inv := Invitation{Status: testcase.status, ExpiresAt: testcase.expiresAt}
+		result := inv.currentStatus(now)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
+
+func Test_expireInvitations(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&Invitation{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&Invitation{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateInvitations(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	invitations := []Invitation{
+		{Inviter: 1, Invitee: 2, GroupId: 1, Status: InvitationStatusPending, ExpiresAt: now.Add(-time.Hour)},
+		{Inviter: 1, Invitee: 3, GroupId: 1, Status: InvitationStatusPending, ExpiresAt: now.Add(time.Hour)},
+	}
+	for i := range invitations {
+		if err := db.Create(&invitations[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 保留中の招待は同じグループに 1 人 1 つまで
+	duplicate := Invitation{Inviter: 4, Invitee: 3, GroupId: 1, Status: InvitationStatusPending, ExpiresAt: now.Add(time.Hour)}
+	if err := db.Create(&duplicate).Error; err == nil {
+		t.Errorf("Duplicate pending invitation was created")
+	}
+
+	n, err := expireInvitations(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Unexpected number of expired invitations: expected=1, actual=%v\n", n)
+	}
+
+	if _, err := findPendingInvitation(db, uint64(invitations[0].ID), 2, now); !errors.Is(err, ErrInvitation) {
+		t.Errorf("Expired invitation was found: %v\n", err)
+	}
+	if _, err := findPendingInvitation(db, uint64(invitations[1].ID), 2, now); !errors.Is(err, ErrInvitation) {
+		t.Errorf("Invitation for another user was found: %v\n", err)
+	}
+	if inv, err := findPendingInvitation(db, uint64(invitations[1].ID), 3, now); err != nil {
+		t.Error(err)
+	} else if inv.GroupId != 1 {
+		t.Errorf("Unexpected group: expected=1, actual=%v\n", inv.GroupId)
+	}
+}
+
+func Test_handleJoinAlreadyJoined(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	for _, model := range []interface{}{&Member{}, &Group{}, &GroupMembership{}, &Invitation{}, &GroupActivity{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := &App{db: db}
+	userId, err := registerUser(app, "taro", "duos^aev6K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := Group{Name: "group"}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 招待コードで参加した後に、前から届いていた招待を承諾する
+	if err := db.Create(&GroupMembership{UserId: userId, GroupId: group.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	invitation := Invitation{Inviter: 100, Invitee: userId, GroupId: group.ID, Status: InvitationStatusPending, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.Create(&invitation).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	status, reason := postTestForm(app, handleJoin, userId, url.Values{
+		"invitationId": {strconv.FormatUint(uint64(invitation.ID), 10)},
+	})
+	if status != http.StatusNotAcceptable || reason != ErrMsgAlreadyJoined {
+		t.Errorf("Unexpected result: expected=(%v, %v), actual=(%v, %v)\n", http.StatusNotAcceptable, ErrMsgAlreadyJoined, status, reason)
+	}
+
+	var activityCount int64
+	if err := db.Model(&GroupActivity{}).Count(&activityCount).Error; err != nil {
+		t.Fatal(err)
+	}
+	if activityCount != 0 {
+		t.Errorf("Unexpected activity: %v", activityCount)
+	}
+}
@@ -0,0 +1,373 @@
+package be
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgInviteCode    = "招待コードが正しくないか、有効期限が切れています"
+	ErrMsgAlreadyJoined = "既にグループに参加しています"
+)
+
+const (
+	InviteCodeLength = 8
+	// 見間違えやすい文字 (0 と O、1 と I など) は使わない
+	InviteCodeAlphabet   = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	InviteCodeDefaultTTL = 7 * 24 * time.Hour
+	InviteCodeMaxTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInviteCode         = errors.New("invalid invite code")
+	ErrGroupAlreadyJoined = errors.New("already joined the group")
+)
+
+// 誰でも参加できる招待コード (リンクや QR コードにして共有する)
+type GroupInviteCode struct {
+	gorm.Model
+	GroupId   uint `gorm:"index"`
+	CreatedBy uint
+	Code      string `gorm:"unique"`
+	ExpiresAt time.Time
+	// 0 なら回数の制限なし
+	MaxUses   int
+	Uses      int
+	RevokedAt *time.Time
+}
+
+func (ic *GroupInviteCode) isUsable(now time.Time) bool {
+	return ic.RevokedAt == nil && now.Before(ic.ExpiresAt) && (ic.MaxUses == 0 || ic.Uses < ic.MaxUses)
+}
+
+func generateInviteCode() (string, error) {
+	max := big.NewInt(int64(len(InviteCodeAlphabet)))
+	var code strings.Builder
+	for i := 0; i < InviteCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(InviteCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// 手で入力されたコードの区切りや小文字を取り除く
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.Join(strings.Fields(code), "")
+}
+
+func inviteLink(code string) string {
+	return appUrl("/game/?invite=" + url.QueryEscape(code))
+}
+
+// 招待コードでグループに参加する
+func joinByInviteCode(tx *gorm.DB, userId uint, code string, now time.Time) (uint, error) {
+	var inviteCode GroupInviteCode
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&inviteCode, "code = ?", normalizeInviteCode(code)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, ErrInviteCode
+	} else if err != nil {
+		return 0, err
+	}
+	if !inviteCode.isUsable(now) {
+		return 0, ErrInviteCode
+	}
+	// 既に参加している場合は使用回数を増やさない
+	if joined, err := isGroupMember(tx, userId, inviteCode.GroupId); err != nil {
+		return 0, err
+	} else if joined {
+		return 0, ErrGroupAlreadyJoined
+	}
+
+	if err := checkGroupCapacity(tx, inviteCode.GroupId); err != nil {
+		return 0, err
+	}
+	if err := addGroupMember(tx, userId, inviteCode.GroupId, GroupRoleMember); err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&inviteCode).Update("uses", gorm.Expr("uses + 1")).Error; err != nil {
+		return 0, err
+	}
+	if err := recordGroupActivity(tx, inviteCode.GroupId, ActivityMemberJoined, userId, inviteCode.CreatedBy, map[string]interface{}{
+		"via": "invite_code",
+	}); err != nil {
+		return 0, err
+	}
+	return inviteCode.GroupId, nil
+}
+
+type GroupInviteCodeResp struct {
+	Id        uint      `json:"id"`
+	Code      string    `json:"code"`
+	Link      string    `json:"link"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+}
+
+func makeGroupInviteCodeResp(ic *GroupInviteCode) GroupInviteCodeResp {
+	return GroupInviteCodeResp{
+		Id:        ic.ID,
+		Code:      ic.Code,
+		Link:      inviteLink(ic.Code),
+		ExpiresAt: ic.ExpiresAt,
+		MaxUses:   ic.MaxUses,
+		Uses:      ic.Uses,
+	}
+}
+
+func handleCreateInviteCode(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	ttl := InviteCodeDefaultTTL
+	if sHours := c.PostForm("expiresInHours"); sHours != "" {
+		hours, err := strconv.Atoi(sHours)
+		if err != nil || hours <= 0 || time.Duration(hours)*time.Hour > InviteCodeMaxTTL {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(hours) * time.Hour
+	}
+	maxUses := 0
+	if sMaxUses := c.PostForm("maxUses"); sMaxUses != "" {
+		maxUses, err = strconv.Atoi(sMaxUses)
+		if err != nil || maxUses < 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	inviteCode := GroupInviteCode{
+		GroupId:   groupId,
+		CreatedBy: userId,
+		Code:      code,
+		ExpiresAt: time.Now().Add(ttl),
+		MaxUses:   maxUses,
+	}
+	if err := app.db.Create(&inviteCode).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, makeGroupInviteCodeResp(&inviteCode))
+}
+
+// まだ使える招待コードの一覧
+func handleGetInviteCodes(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	now := time.Now()
+	var inviteCodes []GroupInviteCode
+	if err := app.db.Order("created_at").Find(&inviteCodes, "group_id = ? AND revoked_at IS NULL AND expires_at > ?", groupId, now).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	inviteCodesResp := make([]GroupInviteCodeResp, 0)
+	for i := range inviteCodes {
+		if inviteCodes[i].isUsable(now) {
+			inviteCodesResp = append(inviteCodesResp, makeGroupInviteCodeResp(&inviteCodes[i]))
+		}
+	}
+
+	c.JSON(http.StatusOK, inviteCodesResp)
+}
+
+// 作った本人か管理者だけが取り消せる
+func handleRevokeInviteCode(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	inviteCodeId, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var inviteCode GroupInviteCode
+	if err := app.db.First(&inviteCode, inviteCodeId).Error; err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	role, err := getGroupRole(app.db, userId, inviteCode.GroupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if inviteCode.CreatedBy != userId && !isGroupAdminRole(role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if err := app.db.Model(&inviteCode).Update("revoked_at", time.Now()).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleJoinByInviteCode(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var groupId uint
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		groupId, err = joinByInviteCode(tx, userId, c.PostForm("code"), time.Now())
+		return err
+	})
+	if errors.Is(err, ErrInviteCode) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgInviteCode,
+		})
+		return
+	} else if errors.Is(err, ErrGroupAlreadyJoined) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgAlreadyJoined,
+		})
+		return
+	} else if errors.Is(err, ErrGroupFull) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgGroupFull,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	go emitGroupEvent(app, groupId, WebhookEventMemberJoined, map[string]interface{}{
+		"userName": user.UserName,
+	})
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"groupId": groupId,
+	})
+}
+
+// 招待リンクの QR コードを SVG で返す
+func handleGetInviteCodeQr(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var inviteCode GroupInviteCode
+	if err := app.db.First(&inviteCode, "code = ?", normalizeInviteCode(c.Query("code"))).Error; err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if member, err := isGroupMember(app.db, userId, inviteCode.GroupId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	} else if !member || !inviteCode.isUsable(time.Now()) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	qr, err := encodeQrCode([]byte(inviteLink(inviteCode.Code)))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-cache")
+	c.Data(http.StatusOK, "image/svg+xml", []byte(qr.svg()))
+}
@@ -0,0 +1,84 @@
+package be
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_normalizeInviteCode(t *testing.T) {
+	testcases := []struct {
+		code   string
+		result string
+	}{
+		{code: "ABCD2345", result: "ABCD2345"},
+		{code: "abcd-2345", result: "ABCD2345"},
+		{code: " abcd 2345 ", result: "ABCD2345"},
+	}
+	for _, testcase := range testcases {
+		result := normalizeInviteCode(testcase.code)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %q: expected=%v, actual=%v\n", testcase.code, testcase.result, result)
+		}
+	}
+}
+
+func Test_generateInviteCode(t *testing.T) {
+	code, err := generateInviteCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != InviteCodeLength {
+		t.Errorf("Unexpected length: expected=%v, actual=%v\n", InviteCodeLength, len(code))
+	}
+	for _, r := range code {
+		if !strings.ContainsRune(InviteCodeAlphabet, r) {
+			t.Errorf("Unexpected character in %v: %c\n", code, r)
+		}
+	}
+}
+
+func Test_GroupInviteCode_isUsable(t *testing.T) {
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	revokedAt := now.Add(-time.Minute)
+
+	testcases := []struct {
+		name       string
+		inviteCode GroupInviteCode
+		result     bool
+	}{
+		{
+			name:       "unlimited",
+			inviteCode: GroupInviteCode{ExpiresAt: now.Add(time.Hour), Uses: 100},
+			result:     true,
+		},
+		{
+			name:       "remaining uses",
+			inviteCode: GroupInviteCode{ExpiresAt: now.Add(time.Hour), MaxUses: 3, Uses: 2},
+			result:     true,
+		},
+		{
+			name:       "used up",
+			inviteCode: GroupInviteCode{ExpiresAt: now.Add(time.Hour), MaxUses: 3, Uses: 3},
+			result:     false,
+		},
+		{
+			name:       "expired",
+			inviteCode: GroupInviteCode{ExpiresAt: now},
+			result:     false,
+		},
+		{
+			name:       "revoked",
+			inviteCode: GroupInviteCode{ExpiresAt: now.Add(time.Hour), RevokedAt: &revokedAt},
+			result:     false,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := testcase.inviteCode.isUsable(now)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+			}
+		})
+	}
+}
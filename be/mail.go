@@ -0,0 +1,423 @@
+package be
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgEmail = "メールアドレスの形式が正しくありません"
+)
+
+const (
+	MailKindReminder = "reminder"
+	MailKindDigest   = "digest"
+)
+
+const (
+	MailSchedulerPeriod = time.Minute
+	// 起床時刻の何時間前にリマインダーを送るか
+	MailReminderLead       = 10 * time.Hour
+	EmailVerificationValid = 24 * time.Hour
+	// 月曜日の何時 (日本時間) 以降に先週のまとめを送るか
+	MailDigestHour = 9
+)
+
+// メールの送信先 (テストではローカルの SMTP サーバに差し替える)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+type EmailVerification struct {
+	gorm.Model
+	UserId    uint `gorm:"index"`
+	Email     string
+	TokenHash string `gorm:"unique"`
+	ExpiresAt time.Time
+}
+
+// 同じリマインダーやまとめを二重に送らないための記録
+type SentMail struct {
+	gorm.Model
+	UserId uint   `gorm:"uniqueIndex:idx_sent_mail"`
+	Kind   string `gorm:"uniqueIndex:idx_sent_mail"`
+	Key    string `gorm:"uniqueIndex:idx_sent_mail"`
+}
+
+func newSMTPMailer(host, port, username, password, from string) *smtpMailer {
+	m := &smtpMailer{
+		addr: fmt.Sprintf("%s:%s", host, port),
+		from: from,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// 環境変数に SMTP サーバが設定されていればメールを有効にする
+func newSMTPMailerFromEnv() *smtpMailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return newSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+}
+
+func buildMailMessage(from, to, subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+	msg.WriteString("\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	return msg.Bytes()
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMailMessage(m.from, to, subject, body))
+}
+
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// メールなどに載せるアプリの URL
+func appUrl(path string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = primaryOrigin()
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func outcomeLabel(outcome string) string {
+	switch outcome {
+	case OutcomeSuccess:
+		return "成功"
+	case OutcomeFailed:
+		return "失敗"
+	case OutcomeAbsent:
+		return "欠席"
+	case OutcomeExcused:
+		return "お休み"
+	case OutcomeNoGame:
+		return "ゲームなし"
+	}
+	return "-"
+}
+
+// 確認済みのメールアドレスがあるユーザーにだけ送る
+func sendMailToUser(app *App, user *Member, subject, body string) error {
+	if app.mailer == nil || user.Email == "" || !user.EmailVerified {
+		return nil
+	}
+	return app.mailer.Send(user.Email, subject, body)
+}
+
+func sendInvitationMail(app *App, invitee *Member, inviter *Member) {
+	if !invitee.MailInvitation {
+		return
+	}
+	body := fmt.Sprintf("%s さんからグループへの招待が届きました。\n\n以下の URL から確認できます。\n%s\n", inviter.UserName, appUrl("/game/"))
+	if err := sendMailToUser(app, invitee, "グループへの招待が届きました", body); err != nil {
+		log.WithField("userId", invitee.ID).Error(err)
+	}
+}
+
+// 送信済みでなければ記録して true を返す (同時に呼ばれても記録できるのは 1 回だけ)
+func markMailSent(app *App, userId uint, kind, key string) (bool, error) {
+	result := app.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SentMail{UserId: userId, Kind: kind, Key: key})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected != 0, nil
+}
+
+// 翌朝の起床時刻を前日のうちに知らせる
+func sendReminderMails(app *App, now time.Time) error {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return err
+	}
+
+	var groups []Group
+	if err := app.db.Find(&groups).Error; err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		startTime, err := getStartTimeForGroup(app, group.ID)
+		if err != nil {
+			log.WithField("groupId", group.ID).Error(err)
+			continue
+		}
+		if now.Before(startTime.Add(-MailReminderLead)) || !now.Before(startTime.Add(-10*time.Minute)) {
+			continue
+		}
+		date, err := formatStatDate(*startTime)
+		if err != nil {
+			return err
+		}
+
+		var members []Member
+		if err := app.db.Where("id IN (?)", groupMemberIds(app.db, group.ID)).Find(&members, "email_verified = ? AND mail_reminder = ?", true, true).Error; err != nil {
+			return err
+		}
+		// 複数のグループに入っている場合はグループごとに送る
+		key := fmt.Sprintf("%s:%d", date, group.ID)
+		for _, memb := range members {
+			if sent, err := markMailSent(app, memb.ID, MailKindReminder, key); err != nil {
+				log.WithField("userId", memb.ID).Error(err)
+				continue
+			} else if !sent {
+				continue
+			}
+
+			localStart := startTime.In(jst)
+			body := fmt.Sprintf("%d月%d日は %02d:%02d にしりとりが始まります。\n\n%s\n", localStart.Month(), localStart.Day(), localStart.Hour(), localStart.Minute(), appUrl("/game/"))
+			if err := sendMailToUser(app, &memb, "起床時刻のお知らせ", body); err != nil {
+				log.WithField("userId", memb.ID).Error(err)
+			}
+		}
+	}
+	return nil
+}
+
+func buildDigestBody(stats []Statistics) string {
+	var body strings.Builder
+	successCount := 0
+	body.WriteString("先週の結果です。\n\n")
+	for _, s := range stats {
+		fmt.Fprintf(&body, "%s: %s\n", s.Date, outcomeLabel(s.Outcome))
+		if s.Outcome == OutcomeSuccess {
+			successCount++
+		}
+	}
+	fmt.Fprintf(&body, "\n成功した日数: %d日\n", successCount)
+	return body.String()
+}
+
+// 月曜日に先週 1 週間の結果をまとめて送る
+func sendDigestMails(app *App, now time.Time) error {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return err
+	}
+
+	now = now.In(jst)
+	if now.Weekday() != time.Monday || now.Hour() < MailDigestHour {
+		return nil
+	}
+	from := time.Date(now.Year(), now.Month(), now.Day()-7, 0, 0, 0, 0, jst)
+	to := from.AddDate(0, 0, 6)
+	year, week := from.ISOWeek()
+	key := fmt.Sprintf("%04d-W%02d", year, week)
+
+	var members []Member
+	if err := app.db.Find(&members, "email_verified = ? AND mail_digest = ?", true, true).Error; err != nil {
+		return err
+	}
+	for _, memb := range members {
+		if sent, err := markMailSent(app, memb.ID, MailKindDigest, key); err != nil {
+			log.WithField("userId", memb.ID).Error(err)
+			continue
+		} else if !sent {
+			continue
+		}
+
+		var stats []Statistics
+		if err := app.db.Where("user_id = ? AND date BETWEEN ? AND ?", memb.ID, from.Format(StatDateFormat), to.Format(StatDateFormat)).Order("date").Find(&stats).Error; err != nil {
+			return err
+		}
+		if err := sendMailToUser(app, &memb, "先週の結果", buildDigestBody(stats)); err != nil {
+			log.WithField("userId", memb.ID).Error(err)
+		}
+	}
+	return nil
+}
+
+func runMailScheduler(app *App) {
+	ticker := time.NewTicker(MailSchedulerPeriod)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if err := sendReminderMails(app, now); err != nil {
+			log.Error(err)
+		}
+		if err := sendDigestMails(app, now); err != nil {
+			log.Error(err)
+		}
+		<-ticker.C
+	}
+}
+
+func handleSetEmail(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	if app.mailer == nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	email := c.PostForm("email")
+	if !isValidEmail(email) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgEmail,
+		})
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Member{}).Where(userId).Updates(map[string]interface{}{"email": email, "email_verified": false}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userId).Delete(&EmailVerification{}).Error; err != nil {
+			return err
+		}
+		verification := EmailVerification{
+			UserId:    userId,
+			Email:     email,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(EmailVerificationValid),
+		}
+		return tx.Create(&verification).Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	body := fmt.Sprintf("以下の URL を開いてメールアドレスの確認を完了してください。\n%s\n\nこのメールに心当たりがない場合は破棄してください。\n", appUrl("/users/email/verify?token="+token))
+	if err := app.mailer.Send(email, "メールアドレスの確認", body); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleVerifyEmail(app *App, c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		var verification EmailVerification
+		if err := tx.First(&verification, "token_hash = ? AND expires_at > ?", hashToken(token), time.Now()).Error; err != nil {
+			return err
+		}
+		// 確認メールを送った後にアドレスが変更されていたら無効
+		if err := tx.Model(&Member{}).Where("id = ? AND email = ?", verification.UserId, verification.Email).Update("email_verified", true).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&verification).Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/game/")
+}
+
+func handleSetMailSettings(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	updates := make(map[string]interface{})
+	for form, column := range map[string]string{
+		"invitation": "mail_invitation",
+		"reminder":   "mail_reminder",
+		"digest":     "mail_digest",
+	} {
+		value, ok := c.GetPostForm(form)
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		updates[column] = enabled
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	if err := app.db.Model(&Member{}).Where(userId).Updates(updates).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,161 @@
+package be
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// 最低限のコマンドだけを受け付ける SMTP サーバ
+func startFakeSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				received <- strings.Join(data, "\n")
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func Test_smtpMailer_Send(t *testing.T) {
+	addr, received := startFakeSMTPServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := newSMTPMailer(host, port, "", "", "ohatori@example.com")
+	if err := mailer.Send("taro@example.com", "メールアドレスの確認", "おはようございます"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+	header, body, ok := strings.Cut(msg, "\n\n")
+	if !ok {
+		t.Fatalf("Malformed message: %v", msg)
+	}
+	if !strings.Contains(header, "To: taro@example.com") {
+		t.Errorf("Missing recipient: %v", header)
+	}
+	if !strings.Contains(header, "Subject: =?UTF-8?b?") {
+		t.Errorf("Subject is not encoded: %v", header)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(body, "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "おはようございます" {
+		t.Errorf("Unexpected body: %s", decoded)
+	}
+}
+
+func Test_isValidEmail(t *testing.T) {
+	testcases := []struct {
+		name   string
+		input  string
+		result bool
+	}{
+		{
+			name:   "simple",
+			input:  "taro@example.com",
+			result: true,
+		},
+		{
+			name:   "no domain",
+			input:  "taro",
+			result: false,
+		},
+		{
+			name:   "with name",
+			input:  "Taro <taro@example.com>",
+			result: false,
+		},
+		{
+			name:   "empty",
+			input:  "",
+			result: false,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := isValidEmail(testcase.input)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.input, testcase.result, result)
+			}
+		})
+	}
+}
+
+func Test_markMailSent(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&SentMail{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&SentMail{}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{db: db}
+	// 2 回目以降はエラーにせず false を返す
+	testcases := []struct {
+		name   string
+		userId uint
+		key    string
+		result bool
+	}{
+		{name: "first", userId: 1, key: "2022-03-01:1", result: true},
+		{name: "duplicated", userId: 1, key: "2022-03-01:1", result: false},
+		{name: "other key", userId: 1, key: "2022-03-02:1", result: true},
+		{name: "other group", userId: 1, key: "2022-03-01:2", result: true},
+		{name: "other user", userId: 2, key: "2022-03-01:1", result: true},
+	}
+	for _, testcase := range testcases {
+		result, err := markMailSent(app, testcase.userId, MailKindReminder, testcase.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package be
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgNudgeTooOften = "しばらく待ってからもう一度起こしてください"
+	ErrMsgNudgeTarget   = "そのメンバーは起こせません"
+)
+
+const (
+	GameLogKindNudge = "nudge"
+)
+
+// 同じユーザーが続けて起こせるようになるまでの時間
+const NudgeInterval = time.Minute
+
+// ゲームの進行中に起きた出来事の記録
+type GameLog struct {
+	gorm.Model
+	GroupId  uint `gorm:"index"`
+	Date     string
+	Kind     string
+	UserId   uint `gorm:"index"`
+	TargetId uint `gorm:"index"`
+}
+
+type IENudge struct {
+	Channel       chan InternalNotification
+	SenderName    string
+	SenderProfile PlayerProfile
+	TargetId      uint
+	TargetName    string
+	TargetProfile PlayerProfile
+}
+
+// 起こす相手を検索する (同じグループのメンバーでなければエラー)
+func findNudgeTarget(app *App, groupId uint, userName string) (*Member, error) {
+	return findGroupMember(app.db, groupId, userName)
+}
+
+// プッシュ通知・メール・Webhook のうち使えるもので相手に知らせる
+func deliverNudge(app *App, groupId uint, startTime time.Time, senderId uint, nudge IENudge) {
+	date, err := formatStatDate(startTime)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	entry := GameLog{
+		GroupId:  groupId,
+		Date:     date,
+		Kind:     GameLogKindNudge,
+		UserId:   senderId,
+		TargetId: nudge.TargetId,
+	}
+	if err := app.db.Create(&entry).Error; err != nil {
+		log.Error(err)
+	}
+	if err := recordGroupActivity(app.db, groupId, ActivityMemberNudged, senderId, nudge.TargetId, nil); err != nil {
+		log.Error(err)
+	}
+
+	var target Member
+	if err := app.db.First(&target, nudge.TargetId).Error; err != nil {
+		log.Error(err)
+		return
+	}
+
+	msg := PushMessage{
+		Title: "起きてください！",
+		Body:  fmt.Sprintf("%s さんが待っています", nudge.SenderName),
+		Url:   "/game/",
+	}
+	if err := sendPushToUser(app, target.ID, msg); err != nil {
+		log.Error(err)
+	}
+	// 起床時刻のお知らせを止めている人にはメールでは起こさない
+	if target.MailReminder {
+		body := fmt.Sprintf("%s さんがしりとりで待っています。\n\n%s\n", nudge.SenderName, appUrl("/game/"))
+		if err := sendMailToUser(app, &target, msg.Body, body); err != nil {
+			log.Error(err)
+		}
+	}
+
+	emitGroupEvent(app, groupId, WebhookEventMemberNudged, map[string]interface{}{
+		"userName":   nudge.SenderName,
+		"targetName": nudge.TargetName,
+	})
+}
@@ -0,0 +1,542 @@
+package be
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	OidcScope = "openid profile"
+	// iat と exp の時計のずれの許容範囲
+	OidcClockSkew  = time.Minute
+	OidcStateValid = 10 * time.Minute
+	// パスワードのないアカウントは、IdP で認証し直してからこの時間だけ本人確認が必要な操作ができる
+	OidcReauthValid = 10 * time.Minute
+	// ユーザー名が使われていた場合に作り直す回数
+	OidcUserNameAttempts = 10
+)
+
+var (
+	ErrOidcState       = errors.New("oidc: state mismatch")
+	ErrOidcIdToken     = errors.New("oidc: invalid id token")
+	ErrOidcKeyNotFound = errors.New("oidc: signing key not found")
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// 外部の IdP のアカウントとの対応
+type OidcIdentity struct {
+	gorm.Model
+	Issuer  string `gorm:"uniqueIndex:idx_oidc_subject"`
+	Subject string `gorm:"uniqueIndex:idx_oidc_subject"`
+	UserId  uint   `gorm:"index"`
+}
+
+type oidcProvider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+
+	// discovery の結果と JWKS はその都度取得せずに保持する
+	mu                    sync.Mutex
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksUri               string
+	keys                  map[string]*rsa.PublicKey
+}
+
+type oidcClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	Expiry            int64       `json:"exp"`
+	IssuedAt          int64       `json:"iat"`
+	Nonce             string      `json:"nonce"`
+	PreferredUserName string      `json:"preferred_username"`
+}
+
+func newOidcProvider(issuer, clientId, clientSecret, redirectUrl string) *oidcProvider {
+	return &oidcProvider{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectUrl:  redirectUrl,
+	}
+}
+
+// OIDC_ISSUER が設定されていなければ nil を返す
+func newOidcProviderFromEnv() *oidcProvider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	redirectUrl := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectUrl == "" {
+		redirectUrl = appUrl("/users/oidc/callback")
+	}
+	return newOidcProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectUrl)
+}
+
+func (p *oidcProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := oidcClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return err
+	}
+	if strings.TrimRight(config.Issuer, "/") != p.issuer || config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JwksUri == "" {
+		return errors.New("oidc: invalid provider configuration")
+	}
+	p.authorizationEndpoint = config.AuthorizationEndpoint
+	p.tokenEndpoint = config.TokenEndpoint
+	p.jwksUri = config.JwksUri
+	return nil
+}
+
+func (p *oidcProvider) authCodeUrl(state, nonce, verifier string) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientId)
+	params.Set("redirect_uri", p.redirectUrl)
+	params.Set("scope", OidcScope)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authorizationEndpoint + sep + params.Encode(), nil
+}
+
+// 認可コードを ID トークンと交換する
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectUrl)
+	form.Set("client_id", p.clientId)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint: %s", resp.Status)
+	}
+
+	var token struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.IdToken == "" {
+		return "", ErrOidcIdToken
+	}
+	return token.IdToken, nil
+}
+
+func (p *oidcProvider) fetchKeys() error {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksUri, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+// 鍵が見つからなければ鍵のローテーションを考えて取り直す
+func (p *oidcProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if err := p.fetchKeys(); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrOidcKeyNotFound
+}
+
+func (c *oidcClaims) hasAudience(clientId string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ID トークンの署名 (RS256) とクレームを検証する
+func (p *oidcProvider) verifyIdToken(idToken, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrOidcIdToken
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrOidcIdToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil || header.Alg != "RS256" {
+		return nil, ErrOidcIdToken
+	}
+
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOidcIdToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, ErrOidcIdToken
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrOidcIdToken
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, ErrOidcIdToken
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != p.issuer || !claims.hasAudience(p.clientId) || claims.Subject == "" {
+		return nil, ErrOidcIdToken
+	}
+	if now.After(time.Unix(claims.Expiry, 0).Add(OidcClockSkew)) || now.Add(OidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, ErrOidcIdToken
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrOidcIdToken
+	}
+	return &claims, nil
+}
+
+func randomUrlToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IdP のユーザー名から isValidUserName を満たすユーザー名を作る
+func oidcUserNameCandidate(preferred string) string {
+	var b strings.Builder
+	for _, r := range preferred {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '_' || r == '-' {
+			b.WriteRune(r)
+		} else if r == '@' {
+			// メールアドレスの場合はドメインを使わない
+			break
+		}
+	}
+	name := b.String()
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	if len(name) < 3 {
+		name = "user"
+	}
+	return name
+}
+
+// 初めてログインした外部アカウントにはユーザーを作る
+func provisionOidcMember(tx *gorm.DB, issuer string, claims *oidcClaims) (uint, error) {
+	var identity OidcIdentity
+	err := tx.First(&identity, "issuer = ? AND subject = ?", issuer, claims.Subject).Error
+	if err == nil {
+		return identity.UserId, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	base := oidcUserNameCandidate(claims.PreferredUserName)
+	var member Member
+	for i := 0; member.ID == 0; i++ {
+		if i == OidcUserNameAttempts {
+			return 0, errors.New("oidc: could not allocate user name")
+		}
+		candidate := base
+		if i > 0 {
+			// 既に使われていれば乱数を付け足す
+			suffix, err := generateToken()
+			if err != nil {
+				return 0, err
+			}
+			candidate = base + "-" + suffix[:6]
+		}
+
+		// パスワードは設定しない (パスワードではログインできない)
+		// 同時に同じ名前で登録された場合に備えて、確認せずに作成して重複したら作り直す
+		// (トランザクション全体が失敗しないように、セーブポイントの中で作成する)
+		member = Member{UserName: candidate}
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&member).Error
+		})
+		if isUniqueViolation(err) {
+			member.ID = 0
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	identity = OidcIdentity{Issuer: issuer, Subject: claims.Subject, UserId: member.ID}
+	if err := tx.Create(&identity).Error; err != nil {
+		return 0, err
+	}
+	return member.ID, nil
+}
+
+func handleOidcLogin(app *App, c *gin.Context) {
+	if app.oidc == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	sess := sessions.Default(c)
+
+	state, err := randomUrlToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomUrlToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	verifier, err := randomUrlToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	authUrl, err := app.oidc.authCodeUrl(state, nonce, verifier)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	sess.Set("oidc_state", state)
+	sess.Set("oidc_nonce", nonce)
+	sess.Set("oidc_verifier", verifier)
+	sess.Set("oidc_expires", time.Now().Add(OidcStateValid).Unix())
+	if err := sess.Save(); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, authUrl)
+}
+
+func handleOidcCallback(app *App, c *gin.Context) {
+	if app.oidc == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	sess := sessions.Default(c)
+	ip := c.ClientIP()
+
+	state, _ := sess.Get("oidc_state").(string)
+	nonce, _ := sess.Get("oidc_nonce").(string)
+	verifier, _ := sess.Get("oidc_verifier").(string)
+	expires, _ := sess.Get("oidc_expires").(int64)
+	// 使い回せないようにすぐに消す
+	sess.Delete("oidc_state")
+	sess.Delete("oidc_nonce")
+	sess.Delete("oidc_verifier")
+	sess.Delete("oidc_expires")
+	if err := sess.Save(); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if state == "" || c.Query("state") != state || time.Now().Unix() > expires {
+		log.Warn(ErrOidcState)
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	if c.Query("error") != "" {
+		log.WithField("error", c.Query("error")).Warn("OIDC login was rejected")
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	idToken, err := app.oidc.exchange(c.Query("code"), verifier)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	claims, err := app.oidc.verifyIdToken(idToken, nonce, time.Now())
+	if err != nil {
+		log.Warn(err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	var user Member
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		userId, err := provisionOidcMember(tx, app.oidc.issuer, claims)
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&user, userId).Error; err != nil {
+			return err
+		}
+		if user.TotpEnabled {
+			return nil
+		}
+		return recordAudit(tx, userId, AuditEventLoginSucceeded, ip, "oidc")
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// パスワードのないアカウントの本人確認に使う
+	sess.Set("oidc_auth_at", time.Now().Unix())
+	if user.TotpEnabled {
+		// パスワードでのログインと同じく、確認コードを受け取るまではログインさせない
+		if err := startPendingSession(c, user.ID); err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Redirect(http.StatusFound, "/?totpRequired=1")
+		return
+	}
+
+	if err := startSession(app, c, user.ID); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/game/")
+}
+
+// 一意制約に違反したエラーか
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
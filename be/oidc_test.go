@@ -0,0 +1,258 @@
+package be
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// テスト用の IdP
+type testIdp struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdp{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token": idp.sign(t, idp.claims),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *testIdp) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]interface{}{"alg": "RS256", "kid": "test"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func Test_oidcProvider(t *testing.T) {
+	idp := newTestIdp(t)
+	defer idp.server.Close()
+
+	now := time.Now()
+	provider := newOidcProvider(idp.server.URL, "ohatori", "secret", "http://localhost:8000/users/oidc/callback")
+
+	authUrl, err := provider.authCodeUrl("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Query().Get("code_challenge_method") != "S256" || parsed.Query().Get("state") != "state" {
+		t.Errorf("Unexpected authorization url: %v", authUrl)
+	}
+	idp.challenge = parsed.Query().Get("code_challenge")
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                idp.server.URL,
+			"sub":                "subject",
+			"aud":                "ohatori",
+			"exp":                now.Add(time.Hour).Unix(),
+			"iat":                now.Unix(),
+			"nonce":              "nonce",
+			"preferred_username": "taro",
+		}
+	}
+
+	idp.claims = validClaims()
+	if _, err := provider.exchange("code", "wrong verifier"); err == nil {
+		t.Errorf("Token is issued for wrong code verifier")
+	}
+	idToken, err := provider.exchange("code", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := provider.verifyIdToken(idToken, "nonce", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "subject" || claims.PreferredUserName != "taro" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	testcases := []struct {
+		name   string
+		modify func(map[string]interface{})
+	}{
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "other" }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = []string{"other"} }},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validClaims()
+			tc.modify(claims)
+			if _, err := provider.verifyIdToken(idp.sign(t, claims), "nonce", now); err == nil {
+				t.Errorf("Unexpected success for %s", tc.name)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		claims := validClaims()
+		claims["sub"] = "other"
+		payload, _ := json.Marshal(claims)
+		parts := strings.Split(idp.sign(t, validClaims()), ".")
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		if _, err := provider.verifyIdToken(tampered, "nonce", now); err == nil {
+			t.Errorf("Tampered token is accepted")
+		}
+	})
+}
+
+func Test_oidcUserNameCandidate(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "taro", "taro"},
+		{"email", "taro.yamada@example.com", "taroyamada"},
+		{"japanese", "山田太郎", "user"},
+		{"short", "ab", "user"},
+		{"long", "abcdefghijklmnopqrstuvwxyz0123", "abcdefghijklmnopqrstuvwx"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := oidcUserNameCandidate(tc.input)
+			if actual != tc.expected || !isValidUserName(actual) {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_confirmIdentity(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	testcases := []struct {
+		name     string
+		password string
+		input    string
+		authAt   int64
+		expected string
+	}{
+		{"correct password", string(hashed), "password123", 0, ""},
+		{"wrong password", string(hashed), "password456", 0, ErrMsgWrongPassword},
+		{"oidc session is ignored with password", string(hashed), "", now.Unix(), ErrMsgWrongPassword},
+		{"no password, fresh oidc login", "", "", now.Add(-time.Minute).Unix(), ""},
+		{"no password, stale oidc login", "", "", now.Add(-OidcReauthValid - time.Minute).Unix(), ErrMsgReauthRequired},
+		{"no password, no oidc login", "", "", 0, ErrMsgReauthRequired},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual string
+			r := gin.New()
+			r.Use(sessions.Sessions("session", cookie.NewStore([]byte("secret"))))
+			r.POST("/", func(c *gin.Context) {
+				if tc.authAt != 0 {
+					sessions.Default(c).Set("oidc_auth_at", tc.authAt)
+				}
+				actual = confirmIdentity(c, &Member{Password: tc.password}, tc.input)
+			})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_isUniqueViolation(t *testing.T) {
+	testcases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, true},
+		{"wrapped", fmt.Errorf("create: %w", &pgconn.PgError{Code: "23505"}), true},
+		{"other constraint", &pgconn.PgError{Code: "23503"}, false},
+		{"other error", errors.New("connection refused"), false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := isUniqueViolation(tc.err); actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
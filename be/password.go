@@ -0,0 +1,285 @@
+package be
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgWrongPassword = "現在のパスワードが正しくありません"
+	ErrMsgResetToken    = "URL の有効期限が切れています。もう一度やり直してください"
+	// パスワードのないアカウントで、IdP での認証から時間が経っている場合
+	ErrMsgReauthRequired       = "もう一度ログインしてからやり直してください"
+	ErrMsgTooManyResetRequests = "再設定の要求が多すぎます。しばらく待ってからやり直してください"
+)
+
+const PasswordResetValid = time.Hour
+
+const (
+	ThrottleKindResetUser = "reset_user"
+	ThrottleKindResetIp   = "reset_ip"
+	// これを超えて再設定のメールを送ろうとするとロックする (ログインと同じく指数的に伸ばす)
+	PasswordResetFreeRequestsPerUser = 3
+	PasswordResetFreeRequestsPerIp   = 10
+)
+
+type PasswordResetToken struct {
+	gorm.Model
+	UserId    uint   `gorm:"index"`
+	TokenHash string `gorm:"unique"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// 本人確認が必要な操作の前に、パスワードを確認する
+// OIDC で作ったアカウントにはパスワードがないので、直前に IdP で認証し直していれば本人と見なす
+// 確認できなければその理由を返す
+func confirmIdentity(c *gin.Context, user *Member, password string) string {
+	if user.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			return ErrMsgWrongPassword
+		}
+		return ""
+	}
+	authAt, ok := sessions.Default(c).Get("oidc_auth_at").(int64)
+	if !ok || time.Since(time.Unix(authAt, 0)) > OidcReauthValid {
+		return ErrMsgReauthRequired
+	}
+	return ""
+}
+
+func handleChangePassword(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	oldPassword := c.PostForm("oldPassword")
+	newPassword := c.PostForm("newPassword")
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if reason := confirmIdentity(c, &user, oldPassword); reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
+		return
+	}
+
+	if !isValidPassword(newPassword) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPassword,
+		})
+		return
+	}
+
+	hashed, err := hashPassword(newPassword)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Member{}).Where(userId).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		if err := revokeApiTokens(tx, userId); err != nil {
+			return err
+		}
+		// 変更した端末以外はログアウトさせる
+		return invalidateSessions(tx, userId, sess.ID())
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleRequestPasswordReset(app *App, c *gin.Context) {
+	if app.mailer == nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	userName := c.PostForm("userName")
+	ip := c.ClientIP()
+
+	// ユーザーが存在するかどうかは応答から分からないようにする
+	var user Member
+	if err := app.db.First(&user, "user_name = ?", userName).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	canSend := user.ID != 0 && user.Email != "" && user.EmailVerified
+
+	token, err := generateToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var retryAfter time.Duration
+	send := false
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// ログインと同じく、アカウント、IP アドレスの順にロックする
+		userLocked := false
+		if canSend {
+			throttle, err := lockLoginThrottle(tx, ThrottleKindResetUser, userName)
+			if err != nil {
+				return err
+			}
+			userLocked = now.Before(throttle.LockedUntil)
+		}
+		throttle, err := lockLoginThrottle(tx, ThrottleKindResetIp, ip)
+		if err != nil {
+			return err
+		}
+		if now.Before(throttle.LockedUntil) {
+			retryAfter = throttle.LockedUntil.Sub(now)
+			return nil
+		}
+		if _, err := recordLoginFailure(tx, ThrottleKindResetIp, ip, PasswordResetFreeRequestsPerIp, now); err != nil {
+			return err
+		}
+		// アカウントごとの制限は応答を変えずにメールを送らないだけにする
+		if !canSend || userLocked {
+			return nil
+		}
+		if _, err := recordLoginFailure(tx, ThrottleKindResetUser, userName, PasswordResetFreeRequestsPerUser, now); err != nil {
+			return err
+		}
+
+		// 古いトークンは使えなくする
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		resetToken := PasswordResetToken{
+			UserId:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(PasswordResetValid),
+		}
+		send = true
+		return tx.Create(&resetToken).Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTooManyResetRequests,
+		})
+		return
+	}
+
+	if send {
+		body := fmt.Sprintf("以下の URL から新しいパスワードを設定してください (1 時間有効です)。\n%s\n\nこのメールに心当たりがない場合は破棄してください。\n", appUrl("/reset_password/?token="+token))
+		// 送信に失敗しても応答は変えない
+		if err := sendMailToUser(app, &user, "パスワードの再設定", body); err != nil {
+			log.WithField("userId", user.ID).Error(err)
+		}
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func handleResetPassword(app *App, c *gin.Context) {
+	token := c.PostForm("token")
+	password := c.PostForm("password")
+
+	if !isValidPassword(password) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPassword,
+		})
+		return
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var resetToken PasswordResetToken
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.First(&resetToken, "token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), now).Error; err != nil {
+			return err
+		}
+		// 同時に使われても 1 回しか成功しないようにする
+		result := tx.Model(&PasswordResetToken{}).Where("id = ? AND used_at IS NULL", resetToken.ID).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Model(&Member{}).Where(resetToken.UserId).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		if err := revokeApiTokens(tx, resetToken.UserId); err != nil {
+			return err
+		}
+		return invalidateSessions(tx, resetToken.UserId, "")
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgResetToken,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,329 @@
+package be
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setupPasswordTables(t *testing.T) {
+	for _, model := range []interface{}{&Member{}, &PasswordResetToken{}, &MemberSession{}, &ApiToken{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS http_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		key BYTEA,
+		data BYTEA,
+		created_on TIMESTAMPTZ DEFAULT NOW(),
+		modified_on TIMESTAMPTZ,
+		expires_on TIMESTAMPTZ)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM http_sessions").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userId でログインした状態でフォームを送る
+func postTestForm(app *App, handler func(*App, *gin.Context), userId uint, form url.Values) (int, string) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("session", cookie.NewStore([]byte("secret"))))
+	r.POST("/", func(c *gin.Context) {
+		if userId != 0 {
+			sessions.Default(c).Set("user_id", userId)
+		}
+		handler(app, c)
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(w, req)
+
+	var resp struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp.Reason
+}
+
+func passwordMatches(t *testing.T, userId uint, password string) bool {
+	var user Member
+	if err := db.First(&user, userId).Error; err != nil {
+		t.Fatal(err)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
+
+func createTestApiToken(t *testing.T, userId uint) {
+	token := ApiToken{UserId: userId, TokenHash: hashToken("api-token"), Scopes: ApiTokenScopeRead}
+	if err := db.Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countApiTokens(t *testing.T, userId uint) int64 {
+	var count int64
+	if err := db.Model(&ApiToken{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func Test_handleChangePassword(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+	setupPasswordTables(t)
+
+	app := &App{db: db}
+	userId, err := registerUser(app, "taro", "oldPassword1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestApiToken(t, userId)
+
+	testcases := []struct {
+		name        string
+		oldPassword string
+		newPassword string
+		status      int
+		reason      string
+		password    string
+		tokens      int64
+	}{
+		{
+			name:        "wrong old password",
+			oldPassword: "wrongPassword1",
+			newPassword: "newPassword1",
+			status:      http.StatusNotAcceptable,
+			reason:      ErrMsgWrongPassword,
+			password:    "oldPassword1",
+			tokens:      1,
+		},
+		{
+			name:        "invalid new password",
+			oldPassword: "oldPassword1",
+			newPassword: "short",
+			status:      http.StatusNotAcceptable,
+			reason:      ErrMsgPassword,
+			password:    "oldPassword1",
+			tokens:      1,
+		},
+		{
+			name:        "changed",
+			oldPassword: "oldPassword1",
+			newPassword: "newPassword1",
+			status:      http.StatusOK,
+			password:    "newPassword1",
+		},
+		{
+			name:        "old password no longer works",
+			oldPassword: "oldPassword1",
+			newPassword: "newPassword2",
+			status:      http.StatusNotAcceptable,
+			reason:      ErrMsgWrongPassword,
+			password:    "newPassword1",
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			status, reason := postTestForm(app, handleChangePassword, userId, url.Values{
+				"oldPassword": {testcase.oldPassword},
+				"newPassword": {testcase.newPassword},
+			})
+			if status != testcase.status || reason != testcase.reason {
+				t.Errorf("Unexpected result for %s: expected=(%v, %v), actual=(%v, %v)\n", testcase.name, testcase.status, testcase.reason, status, reason)
+			}
+			if !passwordMatches(t, userId, testcase.password) {
+				t.Errorf("Unexpected password for %s: expected=%v\n", testcase.name, testcase.password)
+			}
+			if tokens := countApiTokens(t, userId); tokens != testcase.tokens {
+				t.Errorf("Unexpected API tokens for %s: expected=%v, actual=%v\n", testcase.name, testcase.tokens, tokens)
+			}
+		})
+	}
+}
+
+func Test_handleResetPassword(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+	setupPasswordTables(t)
+
+	app := &App{db: db}
+	userId, err := registerUser(app, "taro", "oldPassword1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestApiToken(t, userId)
+	now := time.Now()
+	usedAt := now.Add(-time.Minute)
+	tokens := []PasswordResetToken{
+		{UserId: userId, TokenHash: hashToken("valid"), ExpiresAt: now.Add(PasswordResetValid)},
+		{UserId: userId, TokenHash: hashToken("expired"), ExpiresAt: now.Add(-time.Second)},
+		{UserId: userId, TokenHash: hashToken("used"), ExpiresAt: now.Add(PasswordResetValid), UsedAt: &usedAt},
+	}
+	for i := range tokens {
+		if err := db.Create(&tokens[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 順番に実行する (valid は 2 回目には使えない)
+	testcases := []struct {
+		name     string
+		token    string
+		input    string
+		status   int
+		reason   string
+		password string
+		tokens   int64
+	}{
+		{name: "expired", token: "expired", input: "newPassword9", status: http.StatusNotAcceptable, reason: ErrMsgResetToken, password: "oldPassword1", tokens: 1},
+		{name: "already used", token: "used", input: "newPassword9", status: http.StatusNotAcceptable, reason: ErrMsgResetToken, password: "oldPassword1", tokens: 1},
+		{name: "unknown", token: "unknown", input: "newPassword9", status: http.StatusNotAcceptable, reason: ErrMsgResetToken, password: "oldPassword1", tokens: 1},
+		{name: "valid", token: "valid", input: "newPassword1", status: http.StatusOK, password: "newPassword1"},
+		{name: "reused", token: "valid", input: "newPassword2", status: http.StatusNotAcceptable, reason: ErrMsgResetToken, password: "newPassword1"},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			status, reason := postTestForm(app, handleResetPassword, 0, url.Values{
+				"token":    {testcase.token},
+				"password": {testcase.input},
+			})
+			if status != testcase.status || reason != testcase.reason {
+				t.Errorf("Unexpected result for %s: expected=(%v, %v), actual=(%v, %v)\n", testcase.name, testcase.status, testcase.reason, status, reason)
+			}
+			if !passwordMatches(t, userId, testcase.password) {
+				t.Errorf("Unexpected password for %s: expected=%v\n", testcase.name, testcase.password)
+			}
+			if tokens := countApiTokens(t, userId); tokens != testcase.tokens {
+				t.Errorf("Unexpected API tokens for %s: expected=%v, actual=%v\n", testcase.name, testcase.tokens, tokens)
+			}
+		})
+	}
+}
+
+// 送ったメールを数える (err を設定すると送信に失敗する)
+type countingMailer struct {
+	sent int
+	err  error
+}
+
+func (m *countingMailer) Send(to, subject, body string) error {
+	m.sent++
+	return m.err
+}
+
+func Test_handleRequestPasswordReset(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+	setupPasswordTables(t)
+	for _, model := range []interface{}{&LoginThrottle{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mailer := &countingMailer{err: errors.New("smtp error")}
+	app := &App{db: db, mailer: mailer}
+	userId, err := registerUser(app, "taro", "oldPassword1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Member{}).Where(userId).Updates(map[string]interface{}{"email": "taro@example.com", "email_verified": true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 順番に実行する (送信に失敗しても、存在しないユーザーでも応答は同じ)
+	testcases := []struct {
+		name     string
+		userName string
+		sent     int
+	}{
+		{name: "unknown user", userName: "jiro", sent: 0},
+		{name: "first", userName: "taro", sent: 1},
+		{name: "second", userName: "taro", sent: 2},
+		{name: "third", userName: "taro", sent: 3},
+		{name: "locked", userName: "taro", sent: 3},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			status, _ := postTestForm(app, handleRequestPasswordReset, 0, url.Values{
+				"userName": {testcase.userName},
+			})
+			if status != http.StatusAccepted || mailer.sent != testcase.sent {
+				t.Errorf("Unexpected result for %s: expected=(%v, %v), actual=(%v, %v)\n", testcase.name, http.StatusAccepted, testcase.sent, status, mailer.sent)
+			}
+		})
+	}
+}
+
+func Test_invalidateSessions(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+	setupPasswordTables(t)
+
+	memberSessions := []MemberSession{
+		{UserId: 1, SessionKey: "CURRENT"},
+		{UserId: 1, SessionKey: "OTHER1"},
+		{UserId: 1, SessionKey: "OTHER2"},
+		{UserId: 2, SessionKey: "ANOTHERUSER"},
+	}
+	for i := range memberSessions {
+		if err := db.Create(&memberSessions[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec("INSERT INTO http_sessions (key, data) VALUES (convert_to(?, 'UTF8'), '')", memberSessions[i].SessionKey).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := invalidateSessions(db, 1, "CURRENT"); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		key    string
+		exists bool
+	}{
+		{key: "CURRENT", exists: true},
+		{key: "OTHER1", exists: false},
+		{key: "OTHER2", exists: false},
+		{key: "ANOTHERUSER", exists: true},
+	}
+	for _, testcase := range testcases {
+		var memberCount, httpCount int64
+		if err := db.Model(&MemberSession{}).Where("session_key = ?", testcase.key).Count(&memberCount).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Raw("SELECT COUNT(*) FROM http_sessions WHERE key = convert_to(?, 'UTF8')", testcase.key).Scan(&httpCount).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (memberCount != 0) != testcase.exists || (httpCount != 0) != testcase.exists {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=(%v, %v)\n", testcase.key, testcase.exists, memberCount, httpCount)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package be
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgDisplayName = "表示名は20文字以内で入力してください"
+	ErrMsgBio         = "自己紹介は160文字以内で入力してください"
+	ErrMsgAvatar      = "画像を読み込めませんでした (5MB までの PNG、JPEG、GIF に対応しています)"
+)
+
+const (
+	DisplayNameMaxLength = 20
+	BioMaxLength         = 160
+)
+
+type Profile struct {
+	gorm.Model
+	UserId      uint `gorm:"uniqueIndex"`
+	DisplayName string
+	Bio         string
+	// BlobStore のキー
+	AvatarKey string
+}
+
+// ゲーム中や一覧でメンバーを表示するための情報
+type PlayerProfile struct {
+	UserName    string `json:"userName"`
+	DisplayName string `json:"displayName"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+func avatarUrl(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "/avatars/" + key
+}
+
+// 表示名が設定されていなければユーザー名を使う
+func makePlayerProfile(member *Member, profile *Profile) PlayerProfile {
+	player := PlayerProfile{
+		UserName:    member.UserName,
+		DisplayName: member.UserName,
+	}
+	if profile != nil {
+		if profile.DisplayName != "" {
+			player.DisplayName = profile.DisplayName
+		}
+		player.AvatarUrl = avatarUrl(profile.AvatarKey)
+	}
+	return player
+}
+
+// ユーザーごとのプロフィール (設定していないユーザーは含まれない)
+func getProfiles(tx *gorm.DB, userIds []uint) (map[uint]*Profile, error) {
+	profiles := make(map[uint]*Profile)
+	if len(userIds) == 0 {
+		return profiles, nil
+	}
+
+	var rows []Profile
+	if err := tx.Find(&rows, "user_id IN ?", userIds).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		profiles[rows[i].UserId] = &rows[i]
+	}
+	return profiles, nil
+}
+
+func loadPlayerProfile(tx *gorm.DB, userId uint) (PlayerProfile, error) {
+	var member Member
+	if err := tx.First(&member, userId).Error; err != nil {
+		return PlayerProfile{}, err
+	}
+	profiles, err := getProfiles(tx, []uint{userId})
+	if err != nil {
+		return PlayerProfile{}, err
+	}
+	return makePlayerProfile(&member, profiles[userId]), nil
+}
+
+// 改行以外の制御文字と、表示を崩す書式文字 (文字の向きの上書きなど) は使えない
+func isDisplayableText(s string, allowNewline bool) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '\n' && allowNewline {
+			continue
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidDisplayName(name string) bool {
+	return utf8.RuneCountInString(name) <= DisplayNameMaxLength && isDisplayableText(name, false)
+}
+
+func isValidBio(bio string) bool {
+	return utf8.RuneCountInString(bio) <= BioMaxLength && isDisplayableText(bio, true)
+}
+
+func upsertProfile(tx *gorm.DB, userId uint, values map[string]interface{}) error {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Profile{UserId: userId}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Profile{}).Where("user_id = ?", userId).Updates(values).Error
+}
+
+func handleSetProfile(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	displayName := strings.TrimSpace(c.PostForm("displayName"))
+	bio := strings.TrimSpace(strings.ReplaceAll(c.PostForm("bio"), "\r\n", "\n"))
+
+	if !isValidDisplayName(displayName) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgDisplayName,
+		})
+		return
+	}
+	if !isValidBio(bio) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgBio,
+		})
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		return upsertProfile(tx, userId, map[string]interface{}{
+			"display_name": displayName,
+			"bio":          bio,
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// 古い画像を消して新しい画像に差し替える
+func replaceAvatar(app *App, userId uint, data []byte) (string, error) {
+	key := ""
+	if data != nil {
+		suffix, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		// キャッシュさせるので、画像を変えるたびに別のキーにする
+		key = "avatar-" + suffix[:32] + ".jpg"
+		if err := app.blobStore.Put(key, data); err != nil {
+			return "", err
+		}
+	}
+
+	var oldKey string
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		profiles, err := getProfiles(tx, []uint{userId})
+		if err != nil {
+			return err
+		}
+		if profile, ok := profiles[userId]; ok {
+			oldKey = profile.AvatarKey
+		}
+		return upsertProfile(tx, userId, map[string]interface{}{
+			"avatar_key": key,
+		})
+	})
+	if err != nil {
+		if key != "" {
+			app.blobStore.Delete(key)
+		}
+		return "", err
+	}
+
+	if oldKey != "" {
+		if err := app.blobStore.Delete(oldKey); err != nil {
+			log.Error(err)
+		}
+	}
+	return key, nil
+}
+
+func handleUploadAvatar(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, AvatarMaxBytes+(64<<10))
+	file, _, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgAvatar,
+		})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, AvatarMaxBytes+1))
+	if err != nil || len(data) > AvatarMaxBytes {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgAvatar,
+		})
+		return
+	}
+
+	avatar, err := processAvatar(data)
+	if errors.Is(err, ErrAvatarImage) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgAvatar,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	key, err := replaceAvatar(app, userId, avatar)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"avatarUrl": avatarUrl(key),
+	})
+}
+
+func handleDeleteAvatar(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	if _, err := replaceAvatar(app, userId, nil); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleGetAvatar(app *App, c *gin.Context) {
+	key := c.Param("key")
+	if !strings.HasPrefix(key, "avatar-") {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	data, err := app.blobStore.Get(key)
+	if errors.Is(err, ErrBlobNotFound) || errors.Is(err, ErrInvalidBlobKey) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// キーは画像ごとに変わるので、ずっとキャッシュしてよい
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "image/jpeg", data)
+}
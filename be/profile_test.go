@@ -0,0 +1,183 @@
+package be
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func Test_isValidDisplayName(t *testing.T) {
+	testcases := []struct {
+		name        string
+		displayName string
+		result      bool
+	}{
+		{
+			name:        "empty",
+			displayName: "",
+			result:      true,
+		},
+		{
+			name:        "japanese",
+			displayName: "おはとり太郎",
+			result:      true,
+		},
+		{
+			name:        "emoji",
+			displayName: "🐔 taro",
+			result:      true,
+		},
+		{
+			name:        "max length",
+			displayName: strings.Repeat("あ", DisplayNameMaxLength),
+			result:      true,
+		},
+		{
+			name:        "too long",
+			displayName: strings.Repeat("あ", DisplayNameMaxLength+1),
+			result:      false,
+		},
+		{
+			name:        "newline",
+			displayName: "taro\nhanako",
+			result:      false,
+		},
+		{
+			name:        "bidi override",
+			displayName: "taro‮gnp.exe",
+			result:      false,
+		},
+		{
+			name:        "invalid utf-8",
+			displayName: "taro\xff",
+			result:      false,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := isValidDisplayName(testcase.displayName)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %q: expected=%v, actual=%v\n", testcase.displayName, testcase.result, result)
+			}
+		})
+	}
+}
+
+func Test_isValidBio(t *testing.T) {
+	testcases := []struct {
+		name   string
+		bio    string
+		result bool
+	}{
+		{
+			name:   "multiline",
+			bio:    "早起きが苦手です\nよろしく",
+			result: true,
+		},
+		{
+			name:   "too long",
+			bio:    strings.Repeat("a", BioMaxLength+1),
+			result: false,
+		},
+		{
+			name:   "control character",
+			bio:    "hello\x07",
+			result: false,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := isValidBio(testcase.bio)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %q: expected=%v, actual=%v\n", testcase.bio, testcase.result, result)
+			}
+		})
+	}
+}
+
+func Test_makePlayerProfile(t *testing.T) {
+	member := Member{UserName: "taro"}
+
+	player := makePlayerProfile(&member, nil)
+	if player.DisplayName != "taro" || player.AvatarUrl != "" {
+		t.Errorf("Unexpected profile without settings: %+v\n", player)
+	}
+
+	player = makePlayerProfile(&member, &Profile{DisplayName: "たろう", AvatarKey: "avatar-abc.jpg"})
+	if player.UserName != "taro" || player.DisplayName != "たろう" || player.AvatarUrl != "/avatars/avatar-abc.jpg" {
+		t.Errorf("Unexpected profile with settings: %+v\n", player)
+	}
+}
+
+func Test_processAvatar(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	avatar, err := processAvatar(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(avatar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" {
+		t.Errorf("Unexpected format: expected=jpeg, actual=%v\n", format)
+	}
+	if img.Bounds().Dx() != AvatarSize || img.Bounds().Dy() != AvatarSize {
+		t.Errorf("Unexpected size: expected=%v, actual=%v\n", AvatarSize, img.Bounds().Size())
+	}
+
+	if _, err := processAvatar([]byte("not an image")); !errors.Is(err, ErrAvatarImage) {
+		t.Errorf("Unexpected result for garbage: expected=%v, actual=%v\n", ErrAvatarImage, err)
+	}
+
+	// ファイルは小さくても展開すると大きすぎる画像
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, AvatarMaxDimension+1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processAvatar(buf.Bytes()); !errors.Is(err, ErrAvatarImage) {
+		t.Errorf("Unexpected result for too wide image: expected=%v, actual=%v\n", ErrAvatarImage, err)
+	}
+}
+
+func Test_diskBlobStore(t *testing.T) {
+	store, err := newDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("avatar-1.jpg", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get("avatar-1.jpg")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Unexpected result of Get: data=%q, err=%v\n", data, err)
+	}
+
+	if err := store.Delete("avatar-1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("avatar-1.jpg"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Unexpected result after Delete: expected=%v, actual=%v\n", ErrBlobNotFound, err)
+	}
+
+	for _, key := range []string{"", "../secret", ".tmp-1", "Avatar.jpg", "a/b"} {
+		if err := store.Put(key, []byte("x")); !errors.Is(err, ErrInvalidBlobKey) {
+			t.Errorf("Unexpected result for %q: expected=%v, actual=%v\n", key, ErrInvalidBlobKey, err)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgProposalExists = "起床時刻の変更が既に提案されています"
+	ErrMsgProposal       = "提案が見つからないか、既に締め切られています"
+)
+
+const (
+	ProposalStatusPending = "pending"
+	// 可決されたが、ゲームの時間帯なので反映を待っている
+	ProposalStatusApproved  = "approved"
+	ProposalStatusApplied   = "applied"
+	ProposalStatusRejected  = "rejected"
+	ProposalStatusCancelled = "cancelled"
+)
+
+const (
+	// この時間までに否決されなければ変更する
+	ProposalTimeout         = 24 * time.Hour
+	ProposalSchedulerPeriod = time.Minute
+)
+
+var ErrProposal = errors.New("proposal not found")
+
+// 起床時刻の変更の提案
+type WakeUpTimeProposal struct {
+	gorm.Model
+	GroupId    uint `gorm:"index"`
+	ProposedBy uint
+	// UTC の "15:04" 形式
+	WakeUpTime string
+	Status     string `gorm:"default:'pending'"`
+	ExpiresAt  time.Time
+	ResolvedAt *time.Time
+}
+
+type WakeUpTimeVote struct {
+	gorm.Model
+	ProposalId uint `gorm:"uniqueIndex:idx_wake_up_time_vote"`
+	UserId     uint `gorm:"uniqueIndex:idx_wake_up_time_vote;index"`
+	Approve    bool
+}
+
+// グループごとに締め切られていない提案は 1 つまで
+func migrateWakeUpTimeProposals(db *gorm.DB) error {
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_wake_up_time_proposal_open ON wake_up_time_proposals (group_id) WHERE status IN ('pending', 'approved') AND deleted_at IS NULL").Error
+}
+
+// 賛成が percent % 以上になれば可決、残りの全員が賛成しても届かなければ否決
+func tallyVotes(approvals, rejections, memberCount, percent int) string {
+	if approvals*100 >= memberCount*percent {
+		return ProposalStatusApproved
+	}
+	if (memberCount-rejections)*100 < memberCount*percent {
+		return ProposalStatusRejected
+	}
+	return ProposalStatusPending
+}
+
+// 参加受付の開始からゲームが終わるまでの間かどうか
+// wakeUpTime は UTC の "15:04" 形式
+func isDuringGame(wakeUpTime string, now time.Time) (bool, error) {
+	savedTime, err := time.Parse("15:04", wakeUpTime)
+	if err != nil {
+		return false, err
+	}
+
+	now = now.In(time.UTC)
+	for _, day := range []int{-1, 0, 1} {
+		startTime := time.Date(now.Year(), now.Month(), now.Day()+day, savedTime.Hour(), savedTime.Minute(), 0, 0, time.UTC)
+		if !now.Before(startTime.Add(-10*time.Minute)) && now.Before(startTime.Add(10*time.Minute+SecToFinish*time.Second)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 今もグループにいるメンバーの票だけを数える
+func countVotes(tx *gorm.DB, proposal *WakeUpTimeProposal) (int, int, error) {
+	var votes []WakeUpTimeVote
+	if err := tx.Where("user_id IN (?)", groupMemberIds(tx, proposal.GroupId)).Find(&votes, "proposal_id = ?", proposal.ID).Error; err != nil {
+		return 0, 0, err
+	}
+	approvals, rejections := 0, 0
+	for _, vote := range votes {
+		if vote.Approve {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	return approvals, rejections, nil
+}
+
+func closeProposal(tx *gorm.DB, proposal *WakeUpTimeProposal, status string, now time.Time) error {
+	proposal.Status = status
+	proposal.ResolvedAt = &now
+	return tx.Model(proposal).Updates(map[string]interface{}{
+		"status":      status,
+		"resolved_at": now,
+	}).Error
+}
+
+// 票を数えて、可決されていてゲームの時間帯でなければ起床時刻を変更する
+// 起床時刻を変更した場合は true を返す
+func resolveProposal(tx *gorm.DB, proposal *WakeUpTimeProposal, now time.Time) (bool, error) {
+	var group Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, proposal.GroupId).Error; err != nil {
+		return false, err
+	}
+
+	if proposal.Status == ProposalStatusPending {
+		memberCount, err := countGroupMembers(tx, group.ID)
+		if err != nil {
+			return false, err
+		}
+		approvals, rejections, err := countVotes(tx, proposal)
+		if err != nil {
+			return false, err
+		}
+
+		status := tallyVotes(approvals, rejections, memberCount, group.ApprovalPercent)
+		if status == ProposalStatusPending && !now.Before(proposal.ExpiresAt) {
+			status = ProposalStatusApproved
+		}
+		switch status {
+		case ProposalStatusPending:
+			return false, nil
+		case ProposalStatusRejected:
+			if err := recordProposalActivity(tx, proposal, ActivityWakeUpTimeRejected, 0); err != nil {
+				return false, err
+			}
+			return false, closeProposal(tx, proposal, ProposalStatusRejected, now)
+		}
+		proposal.Status = ProposalStatusApproved
+		if err := tx.Model(proposal).Update("status", ProposalStatusApproved).Error; err != nil {
+			return false, err
+		}
+	}
+	if proposal.Status != ProposalStatusApproved {
+		return false, nil
+	}
+
+	// 今日のゲームの途中で時刻が変わらないようにする
+	for _, wakeUpTime := range []string{group.WakeUpTime, proposal.WakeUpTime} {
+		if during, err := isDuringGame(wakeUpTime, now); err != nil || during {
+			return false, err
+		}
+	}
+
+	if err := tx.Model(&group).Update("wake_up_time", proposal.WakeUpTime).Error; err != nil {
+		return false, err
+	}
+	if err := recordProposalActivity(tx, proposal, ActivityWakeUpTimeChanged, 0); err != nil {
+		return false, err
+	}
+	return true, closeProposal(tx, proposal, ProposalStatusApplied, now)
+}
+
+// 起床時刻は日本時間で記録する
+func recordProposalActivity(tx *gorm.DB, proposal *WakeUpTimeProposal, kind string, userId uint) error {
+	wakeUpTime, err := localWakeUpTime(proposal.WakeUpTime)
+	if err != nil {
+		return err
+	}
+	return recordGroupActivity(tx, proposal.GroupId, kind, userId, 0, map[string]interface{}{
+		"proposalId": proposal.ID,
+		"wakeUpTime": wakeUpTime,
+	})
+}
+
+func emitWakeUpTimeChanged(app *App, groupId uint, wakeUpTime string) {
+	localTime, err := localWakeUpTime(wakeUpTime)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	emitGroupEvent(app, groupId, WebhookEventWakeUpTimeChanged, map[string]interface{}{
+		"wakeUpTime": localTime,
+	})
+}
+
+// 期限が来た提案や、ゲームが終わるのを待っていた提案を反映する
+func resolveOpenProposals(app *App, now time.Time) error {
+	var proposalIds []uint
+	if err := app.db.Model(&WakeUpTimeProposal{}).Where("status IN ?", []string{ProposalStatusPending, ProposalStatusApproved}).Pluck("id", &proposalIds).Error; err != nil {
+		return err
+	}
+
+	for _, proposalId := range proposalIds {
+		var proposal WakeUpTimeProposal
+		applied := false
+		err := app.db.Transaction(func(tx *gorm.DB) error {
+			// 投票と同じく提案、グループの順にロックし、取り消されていないか確認し直す
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&proposal, proposalId).Error; err != nil {
+				return err
+			}
+			if proposal.Status != ProposalStatusPending && proposal.Status != ProposalStatusApproved {
+				return nil
+			}
+			var err error
+			applied, err = resolveProposal(tx, &proposal, now)
+			return err
+		})
+		if err != nil {
+			log.WithField("proposalId", proposalId).Error(err)
+			continue
+		}
+		if applied {
+			go emitWakeUpTimeChanged(app, proposal.GroupId, proposal.WakeUpTime)
+		}
+	}
+	return nil
+}
+
+func runProposalScheduler(app *App) {
+	ticker := time.NewTicker(ProposalSchedulerPeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := resolveOpenProposals(app, time.Now()); err != nil {
+			log.Error(err)
+		}
+		<-ticker.C
+	}
+}
+
+// 提案と自分の票を登録する
+func proposeWakeUpTime(tx *gorm.DB, userId, groupId uint, wakeUpTime string, now time.Time) (*WakeUpTimeProposal, bool, error) {
+	var count int64
+	if err := tx.Model(&WakeUpTimeProposal{}).Where("group_id = ? AND status IN ?", groupId, []string{ProposalStatusPending, ProposalStatusApproved}).Count(&count).Error; err != nil {
+		return nil, false, err
+	}
+	if count != 0 {
+		return nil, false, ErrProposal
+	}
+
+	proposal := WakeUpTimeProposal{
+		GroupId:    groupId,
+		ProposedBy: userId,
+		WakeUpTime: wakeUpTime,
+		Status:     ProposalStatusPending,
+		ExpiresAt:  now.Add(ProposalTimeout),
+	}
+	if err := tx.Create(&proposal).Error; err != nil {
+		return nil, false, err
+	}
+	if err := tx.Create(&WakeUpTimeVote{ProposalId: proposal.ID, UserId: userId, Approve: true}).Error; err != nil {
+		return nil, false, err
+	}
+	if err := recordProposalActivity(tx, &proposal, ActivityWakeUpTimeProposed, userId); err != nil {
+		return nil, false, err
+	}
+
+	// 1 人だけのグループならすぐに可決される
+	applied, err := resolveProposal(tx, &proposal, now)
+	if err != nil {
+		return nil, false, err
+	}
+	return &proposal, applied, nil
+}
+
+// 自分が所属するグループの締め切られていない提案を取得する (行をロックする)
+func findOpenProposal(tx *gorm.DB, proposalId uint64, userId uint) (*WakeUpTimeProposal, error) {
+	var proposal WakeUpTimeProposal
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("group_id IN (?)", tx.Model(&GroupMembership{}).Select("group_id").Where("user_id = ?", userId)).First(&proposal, proposalId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrProposal
+	} else if err != nil {
+		return nil, err
+	}
+	if proposal.Status != ProposalStatusPending && proposal.Status != ProposalStatusApproved {
+		return nil, ErrProposal
+	}
+	return &proposal, nil
+}
+
+type WakeUpTimeProposalResp struct {
+	Id         uint      `json:"proposalId"`
+	ProposedBy string    `json:"proposedBy"`
+	WakeUpTime string    `json:"wakeUpTime"`
+	Status     string    `json:"status"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Approvals  []string  `json:"approvals"`
+	Rejections []string  `json:"rejections"`
+	// 自分の票 ("approve", "reject" または未投票なら "")
+	MyVote string `json:"myVote"`
+}
+
+func handleGetWakeUpTimeProposals(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	var proposals []WakeUpTimeProposal
+	if err := app.db.Order("created_at").Find(&proposals, "group_id = ? AND status IN ?", groupId, []string{ProposalStatusPending, ProposalStatusApproved}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	members, err := getGroupMembers(app.db, groupId)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userNames := make(map[uint]string)
+	for _, memb := range members {
+		userNames[memb.ID] = memb.UserName
+	}
+
+	proposalsResp := make([]WakeUpTimeProposalResp, 0)
+	for _, proposal := range proposals {
+		wakeUpTime, err := localWakeUpTime(proposal.WakeUpTime)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		resp := WakeUpTimeProposalResp{
+			Id:         proposal.ID,
+			ProposedBy: userNames[proposal.ProposedBy],
+			WakeUpTime: wakeUpTime,
+			Status:     proposal.Status,
+			ExpiresAt:  proposal.ExpiresAt,
+			Approvals:  make([]string, 0),
+			Rejections: make([]string, 0),
+		}
+
+		var votes []WakeUpTimeVote
+		if err := app.db.Order("id").Find(&votes, "proposal_id = ?", proposal.ID).Error; err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, vote := range votes {
+			userName, ok := userNames[vote.UserId]
+			if !ok {
+				continue
+			}
+			if vote.Approve {
+				resp.Approvals = append(resp.Approvals, userName)
+			} else {
+				resp.Rejections = append(resp.Rejections, userName)
+			}
+			if vote.UserId == userId {
+				resp.MyVote = "reject"
+				if vote.Approve {
+					resp.MyVote = "approve"
+				}
+			}
+		}
+
+		proposalsResp = append(proposalsResp, resp)
+	}
+
+	c.JSON(http.StatusOK, proposalsResp)
+}
+
+func handleVoteWakeUpTime(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	proposalId, err := strconv.ParseUint(c.PostForm("proposalId"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	approve, err := strconv.ParseBool(c.PostForm("approve"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var proposal *WakeUpTimeProposal
+	applied := false
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if proposal, err = findOpenProposal(tx, proposalId, userId); err != nil {
+			return err
+		}
+		// 可決された後は票を変えられない
+		if proposal.Status != ProposalStatusPending {
+			return ErrProposal
+		}
+
+		vote := WakeUpTimeVote{ProposalId: proposal.ID, UserId: userId, Approve: approve}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "proposal_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"approve", "updated_at"}),
+		}).Create(&vote).Error; err != nil {
+			return err
+		}
+
+		applied, err = resolveProposal(tx, proposal, time.Now())
+		return err
+	})
+	if errors.Is(err, ErrProposal) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgProposal,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if applied {
+		go emitWakeUpTimeChanged(app, proposal.GroupId, proposal.WakeUpTime)
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+		"status":  proposal.Status,
+	})
+}
+
+// 提案した本人か管理者が取り下げる
+func handleCancelWakeUpTimeProposal(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	proposalId, err := strconv.ParseUint(c.PostForm("proposalId"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	forbidden := false
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		proposal, err := findOpenProposal(tx, proposalId, userId)
+		if err != nil {
+			return err
+		}
+		if proposal.ProposedBy != userId {
+			role, err := getGroupRole(tx, userId, proposal.GroupId)
+			if err != nil {
+				return err
+			}
+			if !isGroupAdminRole(role) {
+				forbidden = true
+				return nil
+			}
+		}
+		if err := recordProposalActivity(tx, proposal, ActivityWakeUpTimeCancelled, userId); err != nil {
+			return err
+		}
+		return closeProposal(tx, proposal, ProposalStatusCancelled, time.Now())
+	})
+	if errors.Is(err, ErrProposal) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgProposal,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if forbidden {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,56 @@
+package be
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_tallyVotes(t *testing.T) {
+	testcases := []struct {
+		name        string
+		approvals   int
+		rejections  int
+		memberCount int
+		percent     int
+		result      string
+	}{
+		{name: "alone", approvals: 1, memberCount: 1, percent: 51, result: ProposalStatusApproved},
+		{name: "half of two", approvals: 1, memberCount: 2, percent: 51, result: ProposalStatusPending},
+		{name: "majority of three", approvals: 2, memberCount: 3, percent: 51, result: ProposalStatusApproved},
+		{name: "half of four", approvals: 2, rejections: 1, memberCount: 4, percent: 51, result: ProposalStatusPending},
+		{name: "rejected by half of four", approvals: 1, rejections: 2, memberCount: 4, percent: 51, result: ProposalStatusRejected},
+		{name: "unanimity", approvals: 3, memberCount: 4, percent: 100, result: ProposalStatusPending},
+		{name: "unanimity rejected", approvals: 1, rejections: 1, memberCount: 4, percent: 100, result: ProposalStatusRejected},
+	}
+	for _, testcase := range testcases {
+		result := tallyVotes(testcase.approvals, testcase.rejections, testcase.memberCount, testcase.percent)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
+
+func Test_isDuringGame(t *testing.T) {
+	testcases := []struct {
+		name       string
+		wakeUpTime string
+		now        time.Time
+		result     bool
+	}{
+		{name: "before join window", wakeUpTime: "21:00", now: time.Date(2022, 4, 1, 20, 49, 0, 0, time.UTC), result: false},
+		{name: "join window", wakeUpTime: "21:00", now: time.Date(2022, 4, 1, 20, 50, 0, 0, time.UTC), result: true},
+		{name: "game", wakeUpTime: "21:00", now: time.Date(2022, 4, 1, 21, 12, 0, 0, time.UTC), result: true},
+		{name: "after game", wakeUpTime: "21:00", now: time.Date(2022, 4, 1, 21, 30, 0, 0, time.UTC), result: false},
+		{name: "window across midnight", wakeUpTime: "00:05", now: time.Date(2022, 4, 1, 23, 58, 0, 0, time.UTC), result: true},
+		{name: "game across midnight", wakeUpTime: "23:55", now: time.Date(2022, 4, 2, 0, 5, 0, 0, time.UTC), result: true},
+	}
+	for _, testcase := range testcases {
+		result, err := isDuringGame(testcase.wakeUpTime, testcase.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
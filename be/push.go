@@ -0,0 +1,450 @@
+package be
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PushMsgWindowOpenTitle = "おはようございます！"
+	PushMsgWindowOpenBody  = "しりとりの参加受付が始まりました"
+	PushMsgReminderTitle   = "メンバーが待っています"
+	PushMsgReminderBody    = "まだゲームに参加していません"
+)
+
+const (
+	PushSchedulerPeriod = 30 * time.Second
+	// 開始時刻からリマインダーを送るまでの時間
+	PushReminderDelay = 2 * time.Minute
+	PushTTLSec        = 600
+	PushRecordSize    = 4096
+)
+
+var ErrPushSubscriptionGone = errors.New("push subscription is no longer valid")
+
+type PushSubscription struct {
+	gorm.Model
+	UserId   uint   `gorm:"index"`
+	Endpoint string `gorm:"unique"`
+	P256dh   string
+	Auth     string
+}
+
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Url   string `json:"url"`
+}
+
+// プッシュ通知の配送先 (テストではローカルの偽サービスに差し替える)
+type PushSender interface {
+	Send(sub *PushSubscription, payload []byte) error
+}
+
+type webPushSender struct {
+	client     *http.Client
+	privateKey *ecdsa.PrivateKey
+	publicKey  string
+	subject    string
+}
+
+func newWebPushSender(publicKey, privateKey, subject string) (*webPushSender, error) {
+	rawPrivateKey, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	// 鍵の検証と公開鍵の計算は crypto/ecdh に任せる
+	ecdhKey, err := ecdh.P256().NewPrivateKey(rawPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	point := ecdhKey.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: new(big.Int).SetBytes(rawPrivateKey),
+	}
+
+	return &webPushSender{
+		client:     newExternalClient(),
+		privateKey: key,
+		publicKey:  publicKey,
+		subject:    subject,
+	}, nil
+}
+
+// 環境変数に VAPID の鍵が設定されていればプッシュ通知を有効にする
+func newWebPushSenderFromEnv() (*webPushSender, error) {
+	publicKey := os.Getenv("VAPID_PUBLIC_KEY")
+	privateKey := os.Getenv("VAPID_PRIVATE_KEY")
+	if publicKey == "" || privateKey == "" {
+		return nil, nil
+	}
+	return newWebPushSender(publicKey, privateKey, os.Getenv("VAPID_SUBJECT"))
+}
+
+// RFC 8292 の VAPID 用の JWT を作る
+func (s *webPushSender) vapidToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": s.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// RFC 8291 に従ってペイロードを暗号化する (aes128gcm)
+func encryptPushPayload(sub *PushSubscription, payload []byte) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(sub.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(sub.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 最後のレコードであることを示す区切り文字を付ける
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > PushRecordSize {
+		return nil, errors.New("push payload is too large")
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(PushRecordSize))
+	body.WriteByte(byte(len(asPublicBytes)))
+	body.Write(asPublicBytes)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+func (s *webPushSender) Send(sub *PushSubscription, payload []byte) error {
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	token, err := s.vapidToken(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(PushTTLSec))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, s.publicKey))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrPushSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ユーザーの全ての端末に通知を送る
+func sendPushToUser(app *App, userId uint, msg PushMessage) error {
+	if app.pushSender == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	var subs []PushSubscription
+	if err := app.db.Find(&subs, "user_id = ?", userId).Error; err != nil {
+		return err
+	}
+	for i := range subs {
+		err := app.pushSender.Send(&subs[i], payload)
+		if errors.Is(err, ErrPushSubscriptionGone) {
+			if err := app.db.Unscoped().Delete(&subs[i]).Error; err != nil {
+				log.Error(err)
+			}
+		} else if err != nil {
+			log.WithField("userId", userId).Error(err)
+		}
+	}
+	return nil
+}
+
+type pushNotificationKey struct {
+	groupId   uint
+	startTime time.Time
+	reminder  bool
+}
+
+// 参加受付の開始時と、開始後にまだ接続していないメンバーに通知を送る
+func sendScheduledPushes(app *App, now time.Time, sent map[pushNotificationKey]bool) error {
+	var groups []Group
+	if err := app.db.Find(&groups).Error; err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		startTime, err := getStartTimeForGroup(app, group.ID)
+		if err != nil {
+			log.WithField("groupId", group.ID).Error(err)
+			continue
+		}
+
+		// 全員揃わずに失敗するまでの間だけ通知する
+		if now.Before(startTime.Add(-10*time.Minute)) || !now.Before(startTime.Add(6*time.Minute)) {
+			continue
+		}
+
+		key := pushNotificationKey{groupId: group.ID, startTime: *startTime}
+		msg := PushMessage{Title: PushMsgWindowOpenTitle, Body: PushMsgWindowOpenBody, Url: "/game/"}
+		if !now.Before(startTime.Add(PushReminderDelay)) {
+			key.reminder = true
+			msg = PushMessage{Title: PushMsgReminderTitle, Body: PushMsgReminderBody, Url: "/game/"}
+		}
+		if sent[key] {
+			continue
+		}
+		sent[key] = true
+
+		members, err := getGroupMembers(app.db, group.ID)
+		if err != nil {
+			return err
+		}
+		for _, memb := range members {
+			if key.reminder && app.gameStates.isConnected(group.ID, memb.ID) {
+				continue
+			}
+			if err := sendPushToUser(app, memb.ID, msg); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	for key := range sent {
+		if now.Sub(key.startTime) > 24*time.Hour {
+			delete(sent, key)
+		}
+	}
+	return nil
+}
+
+func runPushScheduler(app *App) {
+	ticker := time.NewTicker(PushSchedulerPeriod)
+	defer ticker.Stop()
+
+	sent := make(map[pushNotificationKey]bool)
+	for {
+		if err := sendScheduledPushes(app, time.Now(), sent); err != nil {
+			log.Error(err)
+		}
+		<-ticker.C
+	}
+}
+
+type PushSubscriptionReq struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func handleGetVapidPublicKey(app *App, c *gin.Context) {
+	publicKey := os.Getenv("VAPID_PUBLIC_KEY")
+	if app.pushSender == nil || publicKey == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"publicKey": publicKey,
+	})
+}
+
+func handleSubscribePush(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var req PushSubscriptionReq
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	endpoint, err := url.Parse(req.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	if err := checkWebhookHost(ctx, endpoint.Hostname()); err != nil {
+		log.WithField("host", endpoint.Hostname()).Info(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	created := false
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		// 自分の登録は鍵を更新する (他のユーザーが登録した端末は付け替えない)
+		if err := tx.Unscoped().Where("endpoint = ? AND user_id = ?", req.Endpoint, userId).Delete(&PushSubscription{}).Error; err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&PushSubscription{
+			UserId:   userId,
+			Endpoint: req.Endpoint,
+			P256dh:   req.Keys.P256dh,
+			Auth:     req.Keys.Auth,
+		})
+		created = result.RowsAffected != 0
+		return result.Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+func handleUnsubscribePush(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var req PushSubscriptionReq
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+
+	if err := app.db.Unscoped().Where("user_id = ? AND endpoint = ?", userId, req.Endpoint).Delete(&PushSubscription{}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
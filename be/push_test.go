@@ -0,0 +1,189 @@
+package be
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ブラウザ側の処理を真似てペイロードを復号する
+func decryptPushPayload(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	salt := body[:16]
+	idLen := int(body[20])
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(body[16:20]) != PushRecordSize {
+		t.Fatalf("Unexpected record size: %v", binary.BigEndian.Uint32(body[16:20]))
+	}
+
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic.Bytes()...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm)
+	cek := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	nonce := make([]byte, 12)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatalf("Missing padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+func newTestPushSender(t *testing.T) *webPushSender {
+	vapidKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newWebPushSender(
+		base64.RawURLEncoding.EncodeToString(vapidKey.PublicKey().Bytes()),
+		base64.RawURLEncoding.EncodeToString(vapidKey.Bytes()),
+		"mailto:test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+func Test_newWebPushSender(t *testing.T) {
+	sender := newTestPushSender(t)
+	publicKey, err := base64.RawURLEncoding.DecodeString(sender.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sender.privateKey
+	point := append([]byte{4}, append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)...)
+	if !bytes.Equal(point, publicKey) {
+		t.Errorf("Unexpected public key: expected=%x, actual=%x", publicKey, point)
+	}
+
+	digest := sha256.Sum256([]byte("test"))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Errorf("Signature is not valid")
+	}
+}
+
+func Test_webPushSender_Send(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	var received []byte
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("Unexpected encoding: %v", r.Header.Get("Content-Encoding"))
+		}
+		authorization = r.Header.Get("Authorization")
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sender := newTestPushSender(t)
+	sender.client = server.Client()
+	sub := PushSubscription{
+		Endpoint: server.URL + "/push/abc",
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+	payload := []byte(`{"title":"おはようございます！"}`)
+	if err := sender.Send(&sub, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authorization, "vapid t=") || !strings.HasSuffix(authorization, ", k="+sender.publicKey) {
+		t.Errorf("Unexpected authorization header: %v", authorization)
+	}
+	if decrypted := decryptPushPayload(t, uaPrivate, authSecret, received); !bytes.Equal(decrypted, payload) {
+		t.Errorf("Unexpected payload: expected=%s, actual=%s", payload, decrypted)
+	}
+}
+
+func Test_webPushSender_SendLoopback(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// 登録後に内部のアドレスを指すようになった配送先には送らない
+	sender := newTestPushSender(t)
+	sub := PushSubscription{
+		Endpoint: server.URL,
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+	}
+	if err := sender.Send(&sub, []byte("{}")); !errors.Is(err, ErrWebhookAddress) || requested {
+		t.Errorf("Unexpected result: err=%v, requested=%v", err, requested)
+	}
+}
+
+func Test_webPushSender_SendGone(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	sender := newTestPushSender(t)
+	sender.client = server.Client()
+	sub := PushSubscription{
+		Endpoint: server.URL,
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+	}
+	if err := sender.Send(&sub, []byte("{}")); !errors.Is(err, ErrPushSubscriptionGone) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
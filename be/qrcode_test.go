@@ -0,0 +1,98 @@
+package be
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_reedSolomonRemainder(t *testing.T) {
+	// 1-M の "HELLO WORLD" (英数字モード) のデータと誤り訂正符号
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	result := reedSolomonRemainder(data, reedSolomonDivisor(len(expected)))
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Unexpected result: expected=%v, actual=%v\n", expected, result)
+	}
+}
+
+func Test_qrFormatBits(t *testing.T) {
+	testcases := []struct {
+		mask   int
+		result int
+	}{
+		{mask: 0, result: 0b101010000010010},
+		{mask: 4, result: 0b100010111111001},
+		{mask: 5, result: 0b100000011001110},
+		{mask: 7, result: 0b100101010100000},
+	}
+	for _, testcase := range testcases {
+		result := qrFormatBits(testcase.mask)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %v: expected=%015b, actual=%015b\n", testcase.mask, testcase.result, result)
+		}
+	}
+}
+
+func Test_qrVersionBits(t *testing.T) {
+	result := qrVersionBits(7)
+	if result != 0b000111110010010100 {
+		t.Errorf("Unexpected result: expected=%018b, actual=%018b\n", 0b000111110010010100, result)
+	}
+}
+
+func Test_encodeQrCode(t *testing.T) {
+	testcases := []struct {
+		name string
+		data string
+		size int
+	}{
+		{
+			name: "short",
+			data: "ABCDEFGH",
+			size: 21,
+		},
+		{
+			name: "invite link",
+			data: "https://ohatori.example.com/game/?invite=ABCDEFGH",
+			size: 33,
+		},
+		{
+			name: "version 10",
+			data: strings.Repeat("a", 200),
+			size: 57,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			qr, err := encodeQrCode([]byte(testcase.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if qr.size != testcase.size {
+				t.Errorf("Unexpected size: expected=%v, actual=%v\n", testcase.size, qr.size)
+			}
+
+			// 3 つの角に位置検出パターンがある
+			for _, corner := range [][2]int{{0, 0}, {qr.size - 7, 0}, {0, qr.size - 7}} {
+				for i := 0; i < 7; i++ {
+					if !qr.modules[corner[1]][corner[0]+i] || !qr.modules[corner[1]+i][corner[0]] {
+						t.Errorf("Finder pattern is broken at %v\n", corner)
+					}
+				}
+				if qr.modules[corner[1]+1][corner[0]+1] || !qr.modules[corner[1]+3][corner[0]+3] {
+					t.Errorf("Finder pattern is broken at %v\n", corner)
+				}
+			}
+
+			if !strings.HasPrefix(qr.svg(), "<svg ") {
+				t.Errorf("Unexpected svg: %v\n", qr.svg())
+			}
+		})
+	}
+
+	if _, err := encodeQrCode(bytes.Repeat([]byte("a"), 300)); err != ErrQrTooLong {
+		t.Errorf("Unexpected result for too long data: expected=%v, actual=%v\n", ErrQrTooLong, err)
+	}
+}
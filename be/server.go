@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/sessions"
@@ -24,19 +25,35 @@ import (
 
 type Member struct {
 	gorm.Model
-	UserName string `gorm:"unique"`
-	Password string
-	GroupId  uint `gorm:"index"`
+	UserName       string `gorm:"unique"`
+	Password       string
+	Email          string
+	EmailVerified  bool
+	MailInvitation bool `gorm:"default:true"`
+	MailReminder   bool `gorm:"default:true"`
+	MailDigest     bool `gorm:"default:true"`
+	// 二段階認証 (TotpEnabled になるまでは登録途中)
+	TotpSecret   string
+	TotpEnabled  bool
+	TotpLastStep int64
+	// 削除を申請している場合の削除予定日時
+	DeletionScheduledAt *time.Time
 }
 
 type App struct {
 	db         *gorm.DB
 	gameStates GameStates
+	pushSender PushSender
+	mailer     Mailer
+	oidc       *oidcProvider
+	blobStore  BlobStore
 }
 
 func NewApp() *App {
 	app := new(App)
 	app.gameStates.communicators = make(map[uint]chan InternalNotification)
+	app.gameStates.connected = make(map[uint]map[uint]int)
+	app.gameStates.started = make(map[uint]bool)
 	return app
 }
 
@@ -49,6 +66,21 @@ func isFlagEnabled(flags []string, key string) bool {
 	return false
 }
 
+// TRUSTED_PROXIES (カンマ区切りの IP アドレスか CIDR) で X-Forwarded-For を信用するプロキシの一覧
+// Heroku のようにルーターのアドレスが決まっていない環境では、内部ネットワークの範囲 (10.0.0.0/8 など) を指定する
+func trustedProxies() []string {
+	proxies := make([]string, 0)
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if len(proxies) == 0 {
+		return []string{"127.0.0.1"}
+	}
+	return proxies
+}
+
 func launchWebpackServer(runNpmInstall bool) error {
 	if runNpmInstall {
 		cmd := exec.Command("npm", "install")
@@ -111,9 +143,90 @@ func initDatabase(verboseLog bool) (*gorm.DB, error) {
 	if err := db.AutoMigrate(&Invitation{}); err != nil {
 		log.Warn(err)
 	}
+	if err := migrateInvitations(db); err != nil {
+		log.Warn(err)
+	}
 	if err := db.AutoMigrate(&Statistics{}); err != nil {
 		log.Warn(err)
 	}
+	if err := migrateStatistics(db); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&Excusal{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&PushSubscription{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&Webhook{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&WebhookDelivery{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&EmailVerification{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&SentMail{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&GameLog{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&MemberSession{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&PasswordResetToken{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&LoginThrottle{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&AuditLog{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&RecoveryCode{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&PasskeyCredential{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&OidcIdentity{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&ApiToken{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&Profile{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&GroupMembership{}); err != nil {
+		log.Warn(err)
+	}
+	if err := migrateGroupMemberships(db); err != nil {
+		log.Warn(err)
+	}
+	if err := migrateGroupOwners(db); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&GroupInviteCode{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&GroupActivity{}); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&WakeUpTimeProposal{}); err != nil {
+		log.Warn(err)
+	}
+	if err := migrateWakeUpTimeProposals(db); err != nil {
+		log.Warn(err)
+	}
+	if err := db.AutoMigrate(&WakeUpTimeVote{}); err != nil {
+		log.Warn(err)
+	}
+	if err := cleanupEmptyGroups(db); err != nil {
+		log.Warn(err)
+	}
 	return db, nil
 }
 
@@ -143,11 +256,41 @@ func Run() {
 
 	rand.Seed(time.Now().Unix())
 
+	go runSettlementScheduler(app)
+
+	pushSender, err := newWebPushSenderFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pushSender != nil {
+		app.pushSender = pushSender
+		go runPushScheduler(app)
+	}
+
+	go runAccountDeletionScheduler(app)
+
+	go runInvitationSweeper(app)
+
+	go runProposalScheduler(app)
+
+	if mailer := newSMTPMailerFromEnv(); mailer != nil {
+		app.mailer = mailer
+		go runMailScheduler(app)
+	}
+
+	app.oidc = newOidcProviderFromEnv()
+
+	blobStore, err := newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.blobStore = blobStore
+
 	r := gin.Default()
 
 	r.Use(func(c *gin.Context) {
 		if !isDebugMode && c.GetHeader("X-Forwarded-Proto") == "http" {
-			allowedUrl, err := url.Parse(os.Getenv("ALLOWED_ORIGIN"))
+			allowedUrl, err := url.Parse(primaryOrigin())
 			if err != nil {
 				log.Error(err)
 				c.AbortWithStatus(http.StatusInternalServerError)
@@ -162,36 +305,9 @@ func Run() {
 		}
 	})
 
-	r.Use(func(c *gin.Context) {
-		if c.Request.Method == http.MethodPost {
-			if c.GetHeader("Origin") == os.Getenv("ALLOWED_ORIGIN") {
-				return
-			}
-		} else if c.Request.Method == http.MethodGet {
-			if c.GetHeader("Upgrade") == "websocket" {
-				if c.GetHeader("Origin") == os.Getenv("ALLOWED_ORIGIN") {
-					return
-				}
-			} else {
-				return
-			}
-		} else {
-			return
-		}
-		c.Status(http.StatusBadGateway)
-		c.Header("Content-Type", "text/html; charset=utf-8")
-		c.Writer.WriteString(`<!doctype html>
-<html>
-<head>
-    <title>502 Bad Gateway</title>
-</head>
-<body>
-    <h1>502 Bad Gateway</h1>
-</body>
-</html>
-`)
-		c.Abort()
-	})
+	r.Use(apiTokenMiddleware(app))
+
+	r.Use(csrfMiddleware(!isDebugMode))
 
 	sessDB, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -202,11 +318,13 @@ func Run() {
 		log.Fatal(err)
 	}
 	r.Use(sessions.Sessions("session", store))
+	r.Use(apiTokenSessionMiddleware)
+	r.Use(touchSessionMiddleware(app))
 
 	if isFlagEnabled(os.Args[1:], "noproxy") {
 		r.SetTrustedProxies([]string{})
-	} else {
-		r.SetTrustedProxies([]string{"127.0.0.1"})
+	} else if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatal(err)
 	}
 
 	var staticHandler func(*gin.Context)
@@ -235,6 +353,26 @@ func Run() {
 		handleLogin(app, c)
 	})
 
+	r.POST("/users/login/totp", func(c *gin.Context) {
+		handleLoginTotp(app, c)
+	})
+
+	r.POST("/users/passkeys/login/begin", func(c *gin.Context) {
+		handleBeginPasskeyLogin(app, c)
+	})
+
+	r.POST("/users/passkeys/login/finish", func(c *gin.Context) {
+		handleFinishPasskeyLogin(app, c)
+	})
+
+	r.GET("/users/oidc/login", func(c *gin.Context) {
+		handleOidcLogin(app, c)
+	})
+
+	r.GET("/users/oidc/callback", func(c *gin.Context) {
+		handleOidcCallback(app, c)
+	})
+
 	r.GET("/finish/", func(c *gin.Context) {
 		sess := sessions.Default(c)
 		userId := sess.Get("user_id")
@@ -268,9 +406,9 @@ func Run() {
 	})
 
 	r.GET("/logout", func(c *gin.Context) {
-		sess := sessions.Default(c)
-		sess.Clear()
-		sess.Save()
+		if err := endSession(app, c); err != nil {
+			log.Error(err)
+		}
 		c.Redirect(http.StatusFound, "/")
 	})
 
@@ -281,6 +419,137 @@ func Run() {
 	r.GET("/users/statistics", func(c *gin.Context) {
 		handleGetStatistics(app, c)
 	})
+	r.GET("/users/statistics/history", func(c *gin.Context) {
+		handleGetStatisticsHistory(app, c)
+	})
+
+	r.POST("/users/excuse", func(c *gin.Context) {
+		handleExcuse(app, c)
+	})
+
+	r.POST("/users/password", func(c *gin.Context) {
+		handleChangePassword(app, c)
+	})
+
+	r.POST("/users/password/reset_request", func(c *gin.Context) {
+		handleRequestPasswordReset(app, c)
+	})
+
+	r.POST("/users/password/reset", func(c *gin.Context) {
+		handleResetPassword(app, c)
+	})
+
+	r.POST("/users/totp/enroll", func(c *gin.Context) {
+		handleEnrollTotp(app, c)
+	})
+
+	r.POST("/users/totp/confirm", func(c *gin.Context) {
+		handleConfirmTotp(app, c)
+	})
+
+	r.POST("/users/totp/disable", func(c *gin.Context) {
+		handleDisableTotp(app, c)
+	})
+
+	r.GET("/users/passkeys", func(c *gin.Context) {
+		handleGetPasskeys(app, c)
+	})
+
+	r.POST("/users/passkeys/register/begin", func(c *gin.Context) {
+		handleBeginPasskeyRegistration(app, c)
+	})
+
+	r.POST("/users/passkeys/register/finish", func(c *gin.Context) {
+		handleFinishPasskeyRegistration(app, c)
+	})
+
+	r.POST("/users/passkeys/delete", func(c *gin.Context) {
+		handleDeletePasskey(app, c)
+	})
+
+	r.GET("/users/tokens", func(c *gin.Context) {
+		handleGetApiTokens(app, c)
+	})
+
+	r.POST("/users/tokens", func(c *gin.Context) {
+		handleCreateApiToken(app, c)
+	})
+
+	r.POST("/users/tokens/revoke", func(c *gin.Context) {
+		handleRevokeApiToken(app, c)
+	})
+
+	r.GET("/users/sessions", func(c *gin.Context) {
+		handleGetSessions(app, c)
+	})
+
+	r.POST("/users/sessions/revoke", func(c *gin.Context) {
+		handleRevokeSession(app, c)
+	})
+
+	r.POST("/users/profile", func(c *gin.Context) {
+		handleSetProfile(app, c)
+	})
+
+	r.POST("/users/profile/avatar", func(c *gin.Context) {
+		handleUploadAvatar(app, c)
+	})
+
+	r.POST("/users/profile/avatar/delete", func(c *gin.Context) {
+		handleDeleteAvatar(app, c)
+	})
+
+	r.GET("/avatars/:key", func(c *gin.Context) {
+		handleGetAvatar(app, c)
+	})
+
+	r.POST("/users/delete", func(c *gin.Context) {
+		handleDeleteAccount(app, c)
+	})
+
+	r.POST("/users/delete/cancel", func(c *gin.Context) {
+		handleCancelAccountDeletion(app, c)
+	})
+
+	r.POST("/users/email", func(c *gin.Context) {
+		handleSetEmail(app, c)
+	})
+
+	r.GET("/users/email/verify", func(c *gin.Context) {
+		handleVerifyEmail(app, c)
+	})
+
+	r.POST("/users/mail_settings", func(c *gin.Context) {
+		handleSetMailSettings(app, c)
+	})
+
+	r.GET("/push/vapid_public_key", func(c *gin.Context) {
+		handleGetVapidPublicKey(app, c)
+	})
+
+	r.POST("/push/subscribe", func(c *gin.Context) {
+		handleSubscribePush(app, c)
+	})
+
+	r.POST("/push/unsubscribe", func(c *gin.Context) {
+		handleUnsubscribePush(app, c)
+	})
+
+	r.POST("/groups/new", func(c *gin.Context) {
+		handleCreateGroup(app, c)
+	})
+
+	r.GET("/groups/detail", func(c *gin.Context) {
+		handleGetGroup(app, c)
+	})
+
+	r.GET("/groups/activity", func(c *gin.Context) {
+		handleGetGroupActivity(app, c)
+	})
+
+	r.POST("/groups/update", func(c *gin.Context) {
+		handleUpdateGroup(app, c)
+	})
 
 	r.POST("/groups/invite", func(c *gin.Context) {
 		handleInvite(app, c)
@@ -294,6 +563,34 @@ func Run() {
 		handleDeclineInvitations(app, c)
 	})
 
+	r.GET("/groups/invitations/sent", func(c *gin.Context) {
+		handleGetSentInvitations(app, c)
+	})
+
+	r.POST("/groups/invitations/revoke", func(c *gin.Context) {
+		handleRevokeInvitation(app, c)
+	})
+
+	r.GET("/groups/invite_codes", func(c *gin.Context) {
+		handleGetInviteCodes(app, c)
+	})
+
+	r.POST("/groups/invite_codes", func(c *gin.Context) {
+		handleCreateInviteCode(app, c)
+	})
+
+	r.POST("/groups/invite_codes/revoke", func(c *gin.Context) {
+		handleRevokeInviteCode(app, c)
+	})
+
+	r.GET("/groups/invite_codes/qr", func(c *gin.Context) {
+		handleGetInviteCodeQr(app, c)
+	})
+
+	r.POST("/groups/join_code", func(c *gin.Context) {
+		handleJoinByInviteCode(app, c)
+	})
+
 	r.POST("/groups/join", func(c *gin.Context) {
 		handleJoin(app, c)
 	})
@@ -302,9 +599,49 @@ func Run() {
 		handleUnjoin(app, c)
 	})
 
+	r.POST("/groups/members/remove", func(c *gin.Context) {
+		handleRemoveGroupMember(app, c)
+	})
+
+	r.POST("/groups/members/role", func(c *gin.Context) {
+		handleSetGroupRole(app, c)
+	})
+
+	r.POST("/groups/transfer", func(c *gin.Context) {
+		handleTransferGroupOwnership(app, c)
+	})
+
 	r.POST("/groups/wake_up_time", func(c *gin.Context) {
 		handleSetTime(app, c)
 	})
 
+	r.GET("/groups/wake_up_time/proposals", func(c *gin.Context) {
+		handleGetWakeUpTimeProposals(app, c)
+	})
+
+	r.POST("/groups/wake_up_time/vote", func(c *gin.Context) {
+		handleVoteWakeUpTime(app, c)
+	})
+
+	r.POST("/groups/wake_up_time/cancel", func(c *gin.Context) {
+		handleCancelWakeUpTimeProposal(app, c)
+	})
+
+	r.GET("/groups/webhooks", func(c *gin.Context) {
+		handleGetWebhooks(app, c)
+	})
+
+	r.POST("/groups/webhooks", func(c *gin.Context) {
+		handleAddWebhook(app, c)
+	})
+
+	r.POST("/groups/webhooks/delete", func(c *gin.Context) {
+		handleDeleteWebhook(app, c)
+	})
+
+	r.GET("/groups/webhooks/deliveries", func(c *gin.Context) {
+		handleGetWebhookDeliveries(app, c)
+	})
+
 	log.Fatal(r.Run(fmt.Sprintf(":%s", os.Getenv("PORT"))))
 }
@@ -0,0 +1,225 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// 最終アクセス日時の更新はこの間隔より細かくは行わない
+const SessionTouchInterval = 5 * time.Minute
+
+// ユーザーごとのログイン中のセッション (pgstore の http_sessions の key と対応する)
+type MemberSession struct {
+	gorm.Model
+	UserId     uint   `gorm:"index"`
+	SessionKey string `gorm:"index"`
+	UserAgent  string
+	Ip         string
+	LastSeenAt time.Time
+}
+
+// ログイン状態にしてセッションを記録する
+func startSession(app *App, c *gin.Context, userId uint) error {
+	sess := sessions.Default(c)
+	sess.Delete("pending_user_id")
+	sess.Delete("pending_at")
+	sess.Set("user_id", userId)
+	if err := sess.Save(); err != nil {
+		return err
+	}
+
+	return app.db.Create(&MemberSession{
+		UserId:     userId,
+		SessionKey: sess.ID(),
+		UserAgent:  c.Request.UserAgent(),
+		Ip:         c.ClientIP(),
+		LastSeenAt: time.Now(),
+	}).Error
+}
+
+// パスワードの確認だけが済んだ状態にする (二段階認証が終わるまで user_id は設定しない)
+// TotpPendingValid が過ぎたら最初からやり直してもらう
+func startPendingSession(c *gin.Context, userId uint) error {
+	sess := sessions.Default(c)
+	sess.Delete("user_id")
+	sess.Set("pending_user_id", userId)
+	sess.Set("pending_at", time.Now().Unix())
+	return sess.Save()
+}
+
+// 現在のセッションを終了する
+func endSession(app *App, c *gin.Context) error {
+	sess := sessions.Default(c)
+	key := sess.ID()
+	sess.Clear()
+	if err := sess.Save(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return nil
+	}
+	return app.db.Unscoped().Where("session_key = ?", key).Delete(&MemberSession{}).Error
+}
+
+// exceptKey 以外のユーザーのセッションを全て無効にする
+func invalidateSessions(tx *gorm.DB, userId uint, exceptKey string) error {
+	if err := tx.Exec(
+		"DELETE FROM http_sessions WHERE key IN (SELECT convert_to(session_key, 'UTF8') FROM member_sessions WHERE user_id = ? AND session_key <> ?)",
+		userId, exceptKey).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("user_id = ? AND session_key <> ?", userId, exceptKey).Delete(&MemberSession{}).Error
+}
+
+// 指定したセッションを無効にする (他のユーザーのセッションなら ErrRecordNotFound)
+func revokeSession(tx *gorm.DB, userId, sessionId uint) error {
+	var memberSession MemberSession
+	if err := tx.First(&memberSession, "id = ? AND user_id = ?", sessionId, userId).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("DELETE FROM http_sessions WHERE key = convert_to(?, 'UTF8')", memberSession.SessionKey).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(&memberSession).Error
+}
+
+// ログイン中のリクエストごとに最終アクセス日時を記録する (セッションのミドルウェアの後に置く)
+func touchSessionMiddleware(app *App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess := sessions.Default(c)
+		if sess.ID() == "" {
+			return
+		}
+		userId, ok := sess.Get("user_id").(uint)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		touchedAt, _ := sess.Get("touched_at").(int64)
+		if now.Sub(time.Unix(touchedAt, 0)) < SessionTouchInterval {
+			return
+		}
+
+		result := app.db.Model(&MemberSession{}).Where("session_key = ?", sess.ID()).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"ip":           c.ClientIP(),
+		})
+		if result.Error != nil {
+			log.Error(result.Error)
+			return
+		}
+		if result.RowsAffected == 0 {
+			// 記録される前からログインしていたセッションは、ここで記録して取り消せるようにする
+			if err := app.db.Create(&MemberSession{
+				UserId:     userId,
+				SessionKey: sess.ID(),
+				UserAgent:  c.Request.UserAgent(),
+				Ip:         c.ClientIP(),
+				LastSeenAt: now,
+			}).Error; err != nil {
+				log.Error(err)
+				return
+			}
+		}
+		sess.Set("touched_at", now.Unix())
+		if err := sess.Save(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+type SessionResp struct {
+	Id         uint      `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	Ip         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+func handleGetSessions(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	// 期限切れで pgstore から消えたセッションは一覧から消す
+	if err := app.db.Unscoped().
+		Where("user_id = ? AND NOT EXISTS (SELECT 1 FROM http_sessions WHERE key = convert_to(member_sessions.session_key, 'UTF8') AND expires_on > NOW())", userId).
+		Delete(&MemberSession{}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var memberSessions []MemberSession
+	if err := app.db.Order("last_seen_at DESC").Find(&memberSessions, "user_id = ?", userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessionsResp := make([]SessionResp, 0)
+	for _, memberSession := range memberSessions {
+		sessionsResp = append(sessionsResp, SessionResp{
+			Id:         memberSession.ID,
+			UserAgent:  memberSession.UserAgent,
+			Ip:         memberSession.Ip,
+			CreatedAt:  memberSession.CreatedAt,
+			LastSeenAt: memberSession.LastSeenAt,
+			Current:    memberSession.SessionKey == sess.ID(),
+		})
+	}
+
+	c.JSON(http.StatusOK, sessionsResp)
+}
+
+func handleRevokeSession(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	sessionId, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		return revokeSession(tx, userId, uint(sessionId))
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,120 @@
+package be
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func Test_revokeSession(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS http_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		key BYTEA,
+		data BYTEA,
+		created_on TIMESTAMPTZ DEFAULT NOW(),
+		modified_on TIMESTAMPTZ,
+		expires_on TIMESTAMPTZ)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	lost := MemberSession{UserId: 1, SessionKey: "LOSTKEY"}
+	current := MemberSession{UserId: 1, SessionKey: "CURRENTKEY"}
+	for _, memberSession := range []*MemberSession{&lost, &current} {
+		if err := db.Create(memberSession).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec("INSERT INTO http_sessions (key, data) VALUES (convert_to(?, 'UTF8'), '')", memberSession.SessionKey).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 他のユーザーのセッションは取り消せない
+	if err := revokeSession(db, 2, lost.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Unexpected result for other user: %v", err)
+	}
+	if err := revokeSession(db, 1, lost.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var lostCount, currentCount int64
+	db.Raw("SELECT COUNT(*) FROM http_sessions WHERE key = convert_to(?, 'UTF8')", "LOSTKEY").Scan(&lostCount)
+	db.Raw("SELECT COUNT(*) FROM http_sessions WHERE key = convert_to(?, 'UTF8')", "CURRENTKEY").Scan(&currentCount)
+	if lostCount != 0 || currentCount != 1 {
+		t.Errorf("Unexpected sessions: lost=%v, current=%v", lostCount, currentCount)
+	}
+
+	if err := db.Exec("DELETE FROM http_sessions").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ID を持つセッション (Cookie のストアでは ID が空になるため)
+type keyedTestSession struct {
+	apiTokenSession
+	key string
+}
+
+func (s *keyedTestSession) ID() string { return s.key }
+
+func Test_touchSessionMiddleware(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&MemberSession{UserId: 1, SessionKey: "TRACKEDKEY"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{db: db}
+	gin.SetMode(gin.TestMode)
+	for _, key := range []string{"TRACKEDKEY", "UNTRACKEDKEY"} {
+		sess := &keyedTestSession{
+			apiTokenSession: apiTokenSession{values: map[interface{}]interface{}{"user_id": uint(1)}},
+			key:             key,
+		}
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			c.Set(sessions.DefaultKey, sess)
+		})
+		r.Use(touchSessionMiddleware(app))
+		r.GET("/", func(c *gin.Context) {})
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		// 記録されていなかったセッションも、ログイン状態のまま記録される
+		var count int64
+		if err := db.Model(&MemberSession{}).Where("user_id = ? AND session_key = ?", 1, key).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 || sess.Get("user_id") != uint(1) {
+			t.Errorf("Unexpected result for %s: count=%v, user_id=%v\n", key, count, sess.Get("user_id"))
+		}
+	}
+
+	if err := db.Migrator().DropTable(&MemberSession{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,314 @@
+package be
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	OutcomeAbsent  = "absent"
+	OutcomeExcused = "excused"
+	OutcomeNoGame  = "no_game"
+)
+
+const (
+	ErrMsgExcuseTooLate   = "この日の参加受付が既に始まっているため、欠席の届け出はできません"
+	ErrMsgTooManyExcusals = "欠席の届け出が多すぎます"
+)
+
+const (
+	// 参加受付の終了 (開始 10 分後) からゲームが終わるまで待ってから集計する
+	SettleDelay      = 10*time.Minute + SecToFinish*time.Second + 5*time.Minute
+	SettlementPeriod = time.Minute
+	// 参加受付が始まる (開始 10 分前) までに届け出る必要がある
+	ExcuseDeadline = 10 * time.Minute
+	// 今日以降の欠席の届け出を一度に出せる数
+	ExcusalMaxPending = 30
+)
+
+const StatDateFormat = "2006-01-02"
+
+// 欠席の届け出
+type Excusal struct {
+	gorm.Model
+	UserId uint   `gorm:"index"`
+	Date   string `gorm:"index"`
+}
+
+// 日本時間での日付を統計の日付として返す
+func formatStatDate(t time.Time) (string, error) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return "", err
+	}
+	return t.In(jst).Format(StatDateFormat), nil
+}
+
+// date (tz での日付) に行われるゲームの開始時刻を返す
+// wakeUpTime は UTC の "15:04" 形式
+func startTimeOnDate(wakeUpTime string, date time.Time, tz *time.Location) (time.Time, error) {
+	savedTime, err := time.Parse("15:04", wakeUpTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	date = date.In(tz)
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, tz).In(time.UTC)
+	result := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), savedTime.Hour(), savedTime.Minute(), 0, 0, time.UTC)
+	if result.Before(midnight) {
+		result = result.Add(24 * time.Hour)
+	}
+	return result, nil
+}
+
+func isSettlementDue(startTime, now time.Time) bool {
+	return !now.Before(startTime.Add(SettleDelay))
+}
+
+func hasStat(tx *gorm.DB, userId uint, date string) (bool, error) {
+	var count int64
+	if err := tx.Model(&Statistics{}).Where("user_id = ? AND date = ?", userId, date).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// 複数のグループに所属している場合があるので、グループごとに確認する
+func hasGroupStat(tx *gorm.DB, userId, groupId uint, date string) (bool, error) {
+	var count int64
+	if err := tx.Model(&Statistics{}).Where("user_id = ? AND group_id = ? AND date = ?", userId, groupId, date).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func hasExcusal(tx *gorm.DB, userId uint, date string) (bool, error) {
+	var count int64
+	if err := tx.Model(&Excusal{}).Where("user_id = ? AND date = ?", userId, date).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// ゲームに接続しなかったメンバーの結果を記録する
+func settleGroup(app *App, group Group, startTime time.Time) error {
+	date, err := formatStatDate(startTime)
+	if err != nil {
+		return err
+	}
+
+	return app.db.Transaction(func(tx *gorm.DB) error {
+		// ゲームの後でグループに入ったメンバーはその日のゲームに参加できなかったので記録しない
+		var members []Member
+		if err := tx.Where("id IN (?)", groupMemberIds(tx, group.ID).Where("created_at < ?", startTime)).Find(&members).Error; err != nil {
+			return err
+		}
+
+		for _, memb := range members {
+			if recorded, err := hasGroupStat(tx, memb.ID, group.ID, date); err != nil {
+				return err
+			} else if recorded {
+				continue
+			}
+
+			outcome := OutcomeAbsent
+			if excused, err := hasExcusal(tx, memb.ID, date); err != nil {
+				return err
+			} else if excused {
+				outcome = OutcomeExcused
+			}
+
+			stat := Statistics{
+				UserId:  memb.ID,
+				GroupId: group.ID,
+				Date:    date,
+				Outcome: outcome,
+			}
+			// ゲームの結果が同時に記録された場合はそちらを残す
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&stat).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// グループに所属していないメンバーの date の結果を記録する
+func settleUngrouped(app *App, date time.Time, tz *time.Location) error {
+	date = date.In(tz)
+	dateStr := date.Format(StatDateFormat)
+	endOfDay := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, tz)
+
+	return app.db.Transaction(func(tx *gorm.DB) error {
+		var members []Member
+		if err := tx.Where("id NOT IN (?)", tx.Model(&GroupMembership{}).Select("user_id")).Find(&members, "created_at < ?", endOfDay).Error; err != nil {
+			return err
+		}
+
+		for _, memb := range members {
+			if recorded, err := hasStat(tx, memb.ID, dateStr); err != nil {
+				return err
+			} else if recorded {
+				continue
+			}
+
+			stat := Statistics{
+				UserId:  memb.ID,
+				Date:    dateStr,
+				Outcome: OutcomeNoGame,
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&stat).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func settleAll(app *App, now time.Time) error {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return err
+	}
+
+	var groups []Group
+	if err := app.db.Find(&groups).Error; err != nil {
+		return err
+	}
+
+	yesterday := now.In(jst).AddDate(0, 0, -1)
+	for _, group := range groups {
+		// サーバが停止していた場合に備えて前日分も確認する
+		for _, date := range []time.Time{yesterday, now} {
+			startTime, err := startTimeOnDate(group.WakeUpTime, date, jst)
+			if err != nil {
+				log.WithField("groupId", group.ID).Error(err)
+				break
+			}
+			if !isSettlementDue(startTime, now) {
+				continue
+			}
+			if err := settleGroup(app, group, startTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	return settleUngrouped(app, yesterday, jst)
+}
+
+// 定期的に全グループの結果を確定させる
+func runSettlementScheduler(app *App) {
+	ticker := time.NewTicker(SettlementPeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := settleAll(app, time.Now()); err != nil {
+			log.Error(err)
+		}
+		<-ticker.C
+	}
+}
+
+// 所属するいずれかのグループで date の参加受付が始まっていれば true
+// (寝坊した後で届け出て、欠席扱いを免れることができないようにする)
+func isExcuseTooLate(wakeUpTimes []string, date, now time.Time, tz *time.Location) (bool, error) {
+	for _, wakeUpTime := range wakeUpTimes {
+		startTime, err := startTimeOnDate(wakeUpTime, date, tz)
+		if err != nil {
+			return false, err
+		}
+		if !now.Before(startTime.Add(-ExcuseDeadline)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func handleExcuse(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	date, err := time.ParseInLocation(StatDateFormat, c.PostForm("date"), jst)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	now := time.Now().In(jst)
+	if date.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, jst)) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	dateStr := date.Format(StatDateFormat)
+
+	reason := ""
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		// 同時に届け出て上限を超えないように、メンバーの行をロックする
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Member{}, userId).Error; err != nil {
+			return err
+		}
+		if excused, err := hasExcusal(tx, userId, dateStr); err != nil {
+			return err
+		} else if excused {
+			return nil
+		}
+
+		var wakeUpTimes []string
+		if err := tx.Model(&Group{}).Where("id IN (?)", tx.Model(&GroupMembership{}).Select("group_id").Where("user_id = ?", userId)).Pluck("wake_up_time", &wakeUpTimes).Error; err != nil {
+			return err
+		}
+		if tooLate, err := isExcuseTooLate(wakeUpTimes, date, now, jst); err != nil {
+			return err
+		} else if tooLate {
+			reason = ErrMsgExcuseTooLate
+			return nil
+		}
+
+		var pending int64
+		if err := tx.Model(&Excusal{}).Where("user_id = ? AND date >= ?", userId, now.Format(StatDateFormat)).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending >= ExcusalMaxPending {
+			reason = ErrMsgTooManyExcusals
+			return nil
+		}
+		return tx.Create(&Excusal{UserId: userId, Date: dateStr}).Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
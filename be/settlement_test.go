@@ -0,0 +1,219 @@
+package be
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_startTimeOnDate(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name       string
+		wakeUpTime string
+		date       time.Time
+		result     time.Time
+	}{
+		{
+			name:       "morning",
+			wakeUpTime: "22:00",
+			date:       time.Date(2022, 2, 16, 12, 0, 0, 0, jst),
+			result:     time.Date(2022, 2, 16, 7, 0, 0, 0, jst),
+		},
+		{
+			name:       "afternoon",
+			wakeUpTime: "06:30",
+			date:       time.Date(2022, 2, 16, 1, 0, 0, 0, jst),
+			result:     time.Date(2022, 2, 16, 15, 30, 0, 0, jst),
+		},
+		{
+			name:       "midnight",
+			wakeUpTime: "15:00",
+			date:       time.Date(2022, 2, 16, 23, 59, 0, 0, jst),
+			result:     time.Date(2022, 2, 16, 0, 0, 0, 0, jst),
+		},
+		{
+			name:       "different month",
+			wakeUpTime: "21:15",
+			date:       time.Date(2022, 3, 1, 0, 5, 0, 0, jst),
+			result:     time.Date(2022, 3, 1, 6, 15, 0, 0, jst),
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result, err := startTimeOnDate(testcase.wakeUpTime, testcase.date, jst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Equal(testcase.result) {
+				t.Errorf("Unexpected result for %s on %v: expected=%v, actual=%v\n", testcase.wakeUpTime, testcase.date, testcase.result, result.In(jst))
+			}
+		})
+	}
+}
+
+func Test_isSettlementDue(t *testing.T) {
+	startTime := time.Date(2022, 2, 16, 22, 0, 0, 0, time.UTC)
+
+	testcases := []struct {
+		name   string
+		now    time.Time
+		result bool
+	}{
+		{
+			name:   "before start",
+			now:    startTime.Add(-time.Minute),
+			result: false,
+		},
+		{
+			name:   "during game",
+			now:    startTime.Add(12 * time.Minute),
+			result: false,
+		},
+		{
+			name:   "just",
+			now:    startTime.Add(SettleDelay),
+			result: true,
+		},
+		{
+			name:   "next day",
+			now:    startTime.Add(20 * time.Hour),
+			result: true,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := isSettlementDue(startTime, testcase.now)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %v: expected=%v, actual=%v\n", testcase.now, testcase.result, result)
+			}
+		})
+	}
+}
+
+func Test_isExcuseTooLate(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2022, 2, 16, 0, 0, 0, 0, jst)
+
+	testcases := []struct {
+		name        string
+		wakeUpTimes []string
+		now         time.Time
+		result      bool
+	}{
+		{
+			name:        "no group",
+			wakeUpTimes: []string{},
+			now:         time.Date(2022, 2, 16, 23, 0, 0, 0, jst),
+			result:      false,
+		},
+		{
+			name:        "before join window",
+			wakeUpTimes: []string{"22:00"},
+			now:         time.Date(2022, 2, 16, 6, 49, 0, 0, jst),
+			result:      false,
+		},
+		{
+			name:        "join window opened",
+			wakeUpTimes: []string{"22:00"},
+			now:         time.Date(2022, 2, 16, 6, 50, 0, 0, jst),
+			result:      true,
+		},
+		{
+			name:        "after game",
+			wakeUpTimes: []string{"22:00"},
+			now:         time.Date(2022, 2, 16, 9, 0, 0, 0, jst),
+			result:      true,
+		},
+		{
+			name:        "another group has started",
+			wakeUpTimes: []string{"00:00", "21:00"},
+			now:         time.Date(2022, 2, 16, 6, 55, 0, 0, jst),
+			result:      true,
+		},
+		{
+			name:        "future date",
+			wakeUpTimes: []string{"22:00"},
+			now:         time.Date(2022, 2, 15, 9, 0, 0, 0, jst),
+			result:      false,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result, err := isExcuseTooLate(testcase.wakeUpTimes, date, testcase.now, jst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %v at %v: expected=%v, actual=%v\n", testcase.wakeUpTimes, testcase.now, testcase.result, result)
+			}
+		})
+	}
+}
+
+func Test_settleGroup(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	for _, model := range []interface{}{&Member{}, &GroupMembership{}, &Statistics{}, &Excusal{}} {
+		if err := db.Migrator().DropTable(model); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrator().CreateTable(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := &App{db: db}
+	startTime := time.Date(2022, 3, 1, 22, 0, 0, 0, time.UTC)
+	// アカウントはどちらも前から存在するが、late はゲームの後にグループに入った
+	members := []Member{
+		{UserName: "early"},
+		{UserName: "late"},
+	}
+	for i := range members {
+		members[i].CreatedAt = startTime.Add(-48 * time.Hour)
+		if err := db.Create(&members[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	memberships := []GroupMembership{
+		{UserId: members[0].ID, GroupId: 1},
+		{UserId: members[1].ID, GroupId: 1},
+	}
+	memberships[0].CreatedAt = startTime.Add(-time.Hour)
+	memberships[1].CreatedAt = startTime.Add(time.Hour)
+	if err := db.Create(&memberships).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	group := Group{}
+	group.ID = 1
+	if err := settleGroup(app, group, startTime); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		userId   uint
+		recorded bool
+	}{
+		{userId: members[0].ID, recorded: true},
+		{userId: members[1].ID, recorded: false},
+	}
+	for _, testcase := range testcases {
+		var count int64
+		if err := db.Model(&Statistics{}).Where("user_id = ?", testcase.userId).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (count != 0) != testcase.recorded {
+			t.Errorf("Unexpected result for %v: expected=%v, actual=%v\n", testcase.userId, testcase.recorded, count)
+		}
+	}
+}
@@ -1,43 +1,107 @@
 package be
 
 import (
+	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// /users/statistics で返す日数
+	StatisticsRecentDays = 7
+
+	StatisticsHistoryPageSize    = 31
+	StatisticsHistoryMaxPageSize = 366
 )
 
 type Statistics struct {
 	gorm.Model
-	UserId  uint
+	UserId  uint   `gorm:"index:idx_statistics_user_date"`
+	GroupId uint   `gorm:"index:idx_statistics_group_date"`
+	Date    string `gorm:"index:idx_statistics_user_date;index:idx_statistics_group_date"`
+	Outcome string
 	Success bool
 }
 
-func fetchSuccessCountFromDB(app *App, userId uint) (int, error) {
+// 一意制約を作った後は何もしない (重複の削除は全件を走査するので 1 回だけ行う)
+func migrateStatistics(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&Statistics{}, "idx_statistics_user_group_date") {
+		return nil
+	}
+
+	// 集計ジョブ導入前の記録には日付がないので、記録した日時から求める
+	if err := db.Exec(`UPDATE statistics SET date = to_char(created_at AT TIME ZONE 'Asia/Tokyo', 'YYYY-MM-DD')
+		WHERE date IS NULL OR date = ''`).Error; err != nil {
+		return err
+	}
+	// グループに所属していないときの記録は group_id を 0 にそろえる (NULL のままだと一意制約で重複とみなされない)
+	if err := db.Exec("UPDATE statistics SET group_id = 0 WHERE group_id IS NULL").Error; err != nil {
+		return err
+	}
+	// 1 人につきグループごとに 1 日 1 件まで (重複していれば最初のもの以外を削除する)
+	if err := db.Exec(`DELETE FROM statistics WHERE id NOT IN (
+		SELECT MIN(id) FROM statistics GROUP BY user_id, group_id, date)`).Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_statistics_user_group_date ON statistics (user_id, group_id, date)").Error
+}
+
+// groupId が 0 なら全てのグループの記録を対象にする
+func statsQuery(app *App, userId, groupId uint) *gorm.DB {
+	query := app.db.Model(&Statistics{}).Where("user_id = ?", userId)
+	if groupId != 0 {
+		query = query.Where("group_id = ?", groupId)
+	}
+	return query
+}
+
+func fetchSuccessCountFromDB(app *App, userId, groupId uint) (int, error) {
 	var successCount int64
-	if err := app.db.Model(&Statistics{}).Where("user_id = ? AND success = ?", userId, true).Count(&successCount).Error; err != nil {
+	if err := statsQuery(app, userId, groupId).Where("success = ?", true).Count(&successCount).Error; err != nil {
 		return 0, err
 	}
 	return int(successCount), nil
 }
 
-func fetchFailureCountFromDB(app *App, userId uint) (int, error) {
+func fetchFailureCountFromDB(app *App, userId, groupId uint) (int, error) {
 	var failureCount int64
-	if err := app.db.Model(&Statistics{}).Where("user_id = ? AND success = ?", userId, false).Count(&failureCount).Error; err != nil {
+	// Outcome が空のものは集計ジョブ導入前の記録
+	outcomes := []string{"", OutcomeFailed, OutcomeAbsent}
+	if err := statsQuery(app, userId, groupId).Where("success = ? AND outcome IN ?", false, outcomes).Count(&failureCount).Error; err != nil {
 		return 0, err
 	}
 	return int(failureCount), nil
 }
 
-func recordStat(app *App, userId uint, success bool) error {
-	if err := app.db.Create(&Statistics{UserId: userId, Success: success}).Error; err != nil {
+func recordStat(app *App, userId, groupId uint, startTime time.Time, outcome string) error {
+	date, err := formatStatDate(startTime)
+	if err != nil {
+		return err
+	}
+
+	stat := Statistics{
+		UserId:  userId,
+		GroupId: groupId,
+		Date:    date,
+		Outcome: outcome,
+		Success: outcome == OutcomeSuccess,
+	}
+	// 集計ジョブが同じ日の結果を先に記録していれば、そちらを残す
+	if err := app.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&stat).Error; err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func getSuccessCount(app *App, userId uint) (int, error) {
-	count, err := fetchSuccessCountFromDB(app, userId)
+func getSuccessCount(app *App, userId, groupId uint) (int, error) {
+	count, err := fetchSuccessCountFromDB(app, userId, groupId)
 	if err != nil {
 		return 0, err
 	}
@@ -45,8 +109,8 @@ func getSuccessCount(app *App, userId uint) (int, error) {
 	return count, nil
 }
 
-func getFailureCount(app *App, userId uint) (int, error) {
-	count, err := fetchFailureCountFromDB(app, userId)
+func getFailureCount(app *App, userId, groupId uint) (int, error) {
+	count, err := fetchFailureCountFromDB(app, userId, groupId)
 	if err != nil {
 		return 0, err
 	}
@@ -54,36 +118,45 @@ func getFailureCount(app *App, userId uint) (int, error) {
 	return count, nil
 }
 
-func durationDays(from, to time.Time) int {
-	diff := to.Sub(from)
-	return int(diff.Hours()) / 24
-}
-
-func getDaysAfterSignUp(app *App, userId uint) (int, error) {
-	var user Member
-	if err := app.db.First(&user, userId).Error; err != nil {
+// 成功率 (%) を返す (記録がなければ 100)
+func getSuccessRate(app *App, userId, groupId uint) (int, error) {
+	successCount, err := getSuccessCount(app, userId, groupId)
+	if err != nil {
+		return 0, err
+	}
+	failureCount, err := getFailureCount(app, userId, groupId)
+	if err != nil {
 		return 0, err
 	}
 
-	registrationDate := user.CreatedAt
-	now := time.Now()
-	return durationDays(registrationDate, now) + 1, nil
+	// 欠席も失敗として記録されているので、記録された回数がそのまま試行回数になる
+	nTrial := successCount + failureCount
+	if nTrial == 0 {
+		return 100, nil
+	}
+	return successCount * 100 / nTrial, nil
 }
 
-func collectStats(stats []Statistics, wakeUpTime, signUpTime, until time.Time, tz *time.Location) []StatisticsResp {
+func durationDays(from, to time.Time) int {
+	diff := to.Sub(from)
+	return int(diff.Hours()) / 24
+}
+
+// until から遡って最大 maxDays 日分の結果を新しい順に返す
+func collectStats(stats []Statistics, wakeUpTime, signUpTime, until time.Time, tz *time.Location, maxDays int) []StatisticsResp {
 	until = until.In(tz)
 	signUpTime = signUpTime.In(tz)
 	wakeUpTime = wakeUpTime.In(tz)
 
 	if until.Before(wakeUpTime) {
-		until.Add(-24 * time.Hour)
+		until = until.Add(-24 * time.Hour)
 	}
 
 	until = time.Date(until.Year(), until.Month(), until.Day(), signUpTime.Hour(), signUpTime.Minute(), signUpTime.Second(), signUpTime.Nanosecond(), tz)
 
 	duration := durationDays(signUpTime, until)
-	if duration > 7 {
-		duration = 7
+	if duration >= maxDays {
+		duration = maxDays
 	} else {
 		firstWakeUp := time.Date(signUpTime.Year(), signUpTime.Month(), signUpTime.Day(), wakeUpTime.Hour(), wakeUpTime.Minute(), 0, 0, tz)
 		if firstWakeUp.After(signUpTime) {
@@ -91,23 +164,12 @@ func collectStats(stats []Statistics, wakeUpTime, signUpTime, until time.Time, t
 		}
 	}
 	result := make([]StatisticsResp, duration)
-	dataInd := len(stats) - 1
+	// 集計ジョブは翌日に記録することがあるので、記録した日時ではなく記録の日付で分ける
+	outcomes := dailyOutcomes(stats)
 	for i := 0; i < duration; i++ {
 		day := until.Add(-time.Duration(24*i) * time.Hour)
 
-		for j := dataInd; j >= 0; j-- {
-			dataDay := stats[j].CreatedAt.In(tz)
-			if dataDay.Year() == day.Year() && dataDay.Month() == day.Month() && dataDay.Day() == day.Day() {
-				dataInd = j - 1
-				result[i].Success = stats[j].Success
-				break
-			}
-			if dataDay.Before(day) {
-				dataInd = j
-				break
-			}
-		}
-
+		result[i].Success = outcomes[day.Format(StatDateFormat)] == OutcomeSuccess
 		result[i].Year = day.Year()
 		result[i].Month = int(day.Month())
 		result[i].Day = day.Day()
@@ -115,3 +177,176 @@ func collectStats(stats []Statistics, wakeUpTime, signUpTime, until time.Time, t
 
 	return result
 }
+
+// 1 日に複数の記録がある場合に優先する順 (1 つでも失敗していれば失敗)
+var outcomePriority = map[string]int{
+	OutcomeNoGame:  0,
+	OutcomeExcused: 1,
+	OutcomeSuccess: 2,
+	OutcomeAbsent:  3,
+	OutcomeFailed:  4,
+}
+
+// Outcome が空の記録 (集計ジョブ導入前) は成功か失敗のどちらか
+func statOutcome(stat *Statistics) string {
+	if stat.Outcome != "" {
+		return stat.Outcome
+	}
+	if stat.Success {
+		return OutcomeSuccess
+	}
+	return OutcomeFailed
+}
+
+// 日付ごとの結果をまとめる
+func dailyOutcomes(stats []Statistics) map[string]string {
+	outcomes := make(map[string]string)
+	for i := range stats {
+		outcome := statOutcome(&stats[i])
+		if current, ok := outcomes[stats[i].Date]; !ok || outcomePriority[outcome] > outcomePriority[current] {
+			outcomes[stats[i].Date] = outcome
+		}
+	}
+	return outcomes
+}
+
+type StatisticsDayResp struct {
+	Date    string `json:"date"`
+	Year    int    `json:"year"`
+	Month   int    `json:"month"`
+	Day     int    `json:"day"`
+	Outcome string `json:"outcome"`
+	Success bool   `json:"success"`
+}
+
+type StatisticsHistoryResp struct {
+	Days []StatisticsDayResp `json:"days"`
+	// 次のページを取得するときに before に指定する (最後のページなら null)
+	NextCursor *string `json:"nextCursor"`
+}
+
+// dates (新しい順) の日ごとの結果をまとめる
+func collectHistory(stats []Statistics, dates []string) ([]StatisticsDayResp, error) {
+	outcomes := dailyOutcomes(stats)
+	result := make([]StatisticsDayResp, 0, len(dates))
+	for _, date := range dates {
+		day, err := time.Parse(StatDateFormat, date)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, StatisticsDayResp{
+			Date:    date,
+			Year:    day.Year(),
+			Month:   int(day.Month()),
+			Day:     day.Day(),
+			Outcome: outcomes[date],
+			Success: outcomes[date] == OutcomeSuccess,
+		})
+	}
+	return result, nil
+}
+
+type statisticsHistoryQuery struct {
+	// 日本時間の "2006-01-02" 形式 (空なら制限しない)
+	From   string
+	To     string
+	Before string
+	Limit  int
+}
+
+// from, to, before (この日付より前の記録を返す), limit を読み取る
+func parseStatisticsHistoryQuery(c *gin.Context) (statisticsHistoryQuery, bool) {
+	query := statisticsHistoryQuery{
+		From:   c.Query("from"),
+		To:     c.Query("to"),
+		Before: c.Query("before"),
+		Limit:  StatisticsHistoryPageSize,
+	}
+	for _, date := range []string{query.From, query.To, query.Before} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(StatDateFormat, date); err != nil {
+			return statisticsHistoryQuery{}, false
+		}
+	}
+	if query.From != "" && query.To != "" && query.From > query.To {
+		return statisticsHistoryQuery{}, false
+	}
+	if sLimit := c.Query("limit"); sLimit != "" {
+		limit, err := strconv.Atoi(sLimit)
+		if err != nil || limit <= 0 || limit > StatisticsHistoryMaxPageSize {
+			return statisticsHistoryQuery{}, false
+		}
+		query.Limit = limit
+	}
+	return query, true
+}
+
+func handleGetStatisticsHistory(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	// groupId を指定した場合はそのグループの記録だけを返す
+	var groupId uint
+	if c.Query("groupId") != "" {
+		var err error
+		if groupId, err = getGroupId(app, c, userId); err != nil {
+			c.AbortWithStatus(http.StatusNotAcceptable)
+			return
+		}
+	}
+	historyQuery, ok := parseStatisticsHistoryQuery(c)
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// 記録のある日付を新しい順に取得する (次のページがあるか分かるように 1 件多く取得する)
+	dateQuery := statsQuery(app, userId, groupId)
+	if historyQuery.From != "" {
+		dateQuery = dateQuery.Where("date >= ?", historyQuery.From)
+	}
+	if historyQuery.To != "" {
+		dateQuery = dateQuery.Where("date <= ?", historyQuery.To)
+	}
+	if historyQuery.Before != "" {
+		dateQuery = dateQuery.Where("date < ?", historyQuery.Before)
+	}
+	var dates []string
+	if err := dateQuery.Distinct("date").Order("date desc").Limit(historyQuery.Limit+1).Pluck("date", &dates).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var resp StatisticsHistoryResp
+	if len(dates) > historyQuery.Limit {
+		dates = dates[:historyQuery.Limit]
+		resp.NextCursor = &dates[historyQuery.Limit-1]
+	}
+
+	var stats []Statistics
+	if err := statsQuery(app, userId, groupId).Where("date IN ?", dates).Find(&stats).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	days, err := collectHistory(stats, dates)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	resp.Days = days
+
+	c.JSON(http.StatusOK, resp)
+}
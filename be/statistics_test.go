@@ -1,9 +1,12 @@
 package be
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
@@ -74,45 +77,31 @@ func Test_collectStats(t *testing.T) {
 			name: "simple",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 10, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-10",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 11, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-11",
 					Success: false,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 12, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-12",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 15, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-15",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -168,51 +157,35 @@ func Test_collectStats(t *testing.T) {
 			name: "duplicate",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 10, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-10",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 11, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-11",
 					Success: false,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 11, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-11",
 					Success: false,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 12, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-12",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 15, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-15",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -268,33 +241,23 @@ func Test_collectStats(t *testing.T) {
 			name: "missing",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 10, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-10",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 11, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-11",
 					Success: false,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -350,21 +313,15 @@ func Test_collectStats(t *testing.T) {
 			name: "immature account 1",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -402,21 +359,15 @@ func Test_collectStats(t *testing.T) {
 			name: "immature account 2",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -454,27 +405,19 @@ func Test_collectStats(t *testing.T) {
 			name: "immature account 3",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 12, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-12",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
@@ -518,40 +461,27 @@ func Test_collectStats(t *testing.T) {
 			name: "immature account 4",
 			stats: []Statistics{
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 12, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-12",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 13, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-13",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 14, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-14",
 					Success: true,
 				},
 				{
-					Model: gorm.Model{
-						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
-					},
+					Date:    "2022-02-16",
 					Success: true,
 				},
 			},
 			wakeUpTime: time.Date(2022, 2, 16, 7, 15, 0, 0, jst).In(time.UTC),
 			signUpTime: time.Date(2022, 2, 12, 10, 55, 5, 0, jst).In(time.UTC),
 			until:      time.Date(2022, 2, 16, 7, 0, 0, 0, jst),
+			// 起床時刻より前なので 16 日はまだ含めない
 			result: []StatisticsResp{
-				{
-					Year:    2022,
-					Month:   2,
-					Day:     16,
-					Success: true,
-				},
 				{
 					Year:    2022,
 					Month:   2,
@@ -575,16 +505,45 @@ func Test_collectStats(t *testing.T) {
 		{
 			name: "immature account 5",
 			stats: []Statistics{
+				{
+					Date:    "2022-02-16",
+					Success: true,
+				},
+			},
+			wakeUpTime: time.Date(2022, 2, 16, 7, 15, 0, 0, jst).In(time.UTC),
+			signUpTime: time.Date(2022, 2, 16, 7, 10, 5, 0, jst).In(time.UTC),
+			until:      time.Date(2022, 2, 16, 7, 23, 0, 0, jst),
+			result: []StatisticsResp{
+				{
+					Year:    2022,
+					Month:   2,
+					Day:     16,
+					Success: true,
+				},
+			},
+		},
+		{
+			name: "settled on the next day",
+			stats: []Statistics{
+				{
+					Model: gorm.Model{
+						CreatedAt: time.Date(2022, 2, 16, 0, 5, 0, 0, jst).In(time.UTC),
+					},
+					Date:    "2022-02-15",
+					Outcome: OutcomeAbsent,
+				},
 				{
 					Model: gorm.Model{
 						CreatedAt: time.Date(2022, 2, 16, 7, 20, 10, 0, jst).In(time.UTC),
 					},
+					Date:    "2022-02-16",
+					Outcome: OutcomeSuccess,
 					Success: true,
 				},
 			},
 			wakeUpTime: time.Date(2022, 2, 16, 7, 15, 0, 0, jst).In(time.UTC),
-			signUpTime: time.Date(2022, 2, 16, 7, 10, 5, 0, jst).In(time.UTC),
-			until:      time.Date(2022, 2, 16, 7, 23, 0, 0, jst),
+			signUpTime: time.Date(2022, 2, 14, 10, 55, 5, 0, jst).In(time.UTC),
+			until:      time.Date(2022, 2, 16, 7, 21, 0, 0, jst),
 			result: []StatisticsResp{
 				{
 					Year:    2022,
@@ -592,6 +551,34 @@ func Test_collectStats(t *testing.T) {
 					Day:     16,
 					Success: true,
 				},
+				{
+					Year:    2022,
+					Month:   2,
+					Day:     15,
+					Success: false,
+				},
+			},
+		},
+		{
+			// 起床時刻より前はまだ今日の結果を出さない
+			name: "before wake-up",
+			stats: []Statistics{
+				{
+					Date:    "2022-02-15",
+					Outcome: OutcomeSuccess,
+					Success: true,
+				},
+			},
+			wakeUpTime: time.Date(2022, 2, 16, 7, 15, 0, 0, jst).In(time.UTC),
+			signUpTime: time.Date(2022, 2, 14, 10, 55, 5, 0, jst).In(time.UTC),
+			until:      time.Date(2022, 2, 16, 7, 0, 0, 0, jst),
+			result: []StatisticsResp{
+				{
+					Year:    2022,
+					Month:   2,
+					Day:     15,
+					Success: true,
+				},
 			},
 		},
 		{
@@ -613,7 +600,7 @@ func Test_collectStats(t *testing.T) {
 
 	for _, testcase := range testcases {
 		t.Run(testcase.name, func(t *testing.T) {
-			result := collectStats(testcase.stats, testcase.wakeUpTime, testcase.signUpTime, testcase.until, jst)
+			result := collectStats(testcase.stats, testcase.wakeUpTime, testcase.signUpTime, testcase.until, jst, StatisticsRecentDays)
 
 			if len(result) != len(testcase.result) {
 				t.Fatalf("Unexpected length:\n\texpects=%v\n\tactual=%v", len(testcase.result), len(result))
@@ -636,3 +623,105 @@ func Test_collectStats(t *testing.T) {
 		})
 	}
 }
+
+func Test_collectHistory(t *testing.T) {
+	stats := []Statistics{
+		{Date: "2022-03-01", Outcome: OutcomeSuccess, Success: true},
+		// 別のグループで失敗していれば失敗
+		{Date: "2022-03-01", Outcome: OutcomeAbsent},
+		{Date: "2022-02-28", Outcome: OutcomeExcused},
+		{Date: "2022-02-28", Outcome: OutcomeNoGame},
+		// 集計ジョブ導入前の記録
+		{Date: "2022-02-27", Success: true},
+	}
+	expected := []StatisticsDayResp{
+		{Date: "2022-03-01", Year: 2022, Month: 3, Day: 1, Outcome: OutcomeAbsent},
+		{Date: "2022-02-28", Year: 2022, Month: 2, Day: 28, Outcome: OutcomeExcused},
+		{Date: "2022-02-27", Year: 2022, Month: 2, Day: 27, Outcome: OutcomeSuccess, Success: true},
+	}
+
+	result, err := collectHistory(stats, []string{"2022-03-01", "2022-02-28", "2022-02-27"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Unexpected length: expected=%v, actual=%v\n", len(expected), len(result))
+	}
+	for i := range result {
+		if result[i] != expected[i] {
+			t.Errorf("Unexpected result at %v: expected=%+v, actual=%+v\n", i, expected[i], result[i])
+		}
+	}
+}
+
+func Test_parseStatisticsHistoryQuery(t *testing.T) {
+	testcases := []struct {
+		query  string
+		ok     bool
+		result statisticsHistoryQuery
+	}{
+		{query: "", ok: true, result: statisticsHistoryQuery{Limit: StatisticsHistoryPageSize}},
+		{
+			query:  "from=2022-01-01&to=2022-03-31&before=2022-03-01&limit=10",
+			ok:     true,
+			result: statisticsHistoryQuery{From: "2022-01-01", To: "2022-03-31", Before: "2022-03-01", Limit: 10},
+		},
+		{query: "from=2022-04-01&to=2022-03-31", ok: false},
+		{query: "from=2022/01/01", ok: false},
+		{query: "before=yesterday", ok: false},
+		{query: "limit=0", ok: false},
+		{query: "limit=367", ok: false},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, testcase := range testcases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/users/statistics/history?"+testcase.query, nil)
+
+		result, ok := parseStatisticsHistoryQuery(c)
+		if ok != testcase.ok || (ok && result != testcase.result) {
+			t.Errorf("Unexpected result for %q: expected=(%+v, %v), actual=(%+v, %v)\n", testcase.query, testcase.result, testcase.ok, result, ok)
+		}
+	}
+}
+
+func Test_migrateStatistics(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&Statistics{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&Statistics{}); err != nil {
+		t.Fatal(err)
+	}
+	// 以前の記録は group_id が NULL のものがある
+	for i := 0; i < 2; i++ {
+		if err := db.Exec("INSERT INTO statistics (created_at, user_id, group_id, date, success) VALUES (NOW(), 1, NULL, '2022-03-01', true)").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("INSERT INTO statistics (created_at, user_id, group_id, date, success) VALUES (NOW(), 1, 1, '2022-03-01', true)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateStatistics(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := db.Model(&Statistics{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Unexpected result: expected=%v, actual=%v\n", 2, count)
+	}
+
+	// 2 回目以降は何もしない
+	if err := migrateStatistics(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropTable(&Statistics{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package be
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	StreakDaySuccess = "success"
+	StreakDayFailed  = "failed"
+	// 欠席の届け出やゲームがなかった日は連続記録を途切れさせない
+	StreakDaySkipped = "skipped"
+)
+
+// 連続記録を知らせる日数 (これより後は 100 日ごと)
+var streakMilestones = []int{3, 7, 14, 30, 50, 100}
+
+type StreakResp struct {
+	Current int `json:"current"`
+	Longest int `json:"longest"`
+}
+
+// 日付ごとにまとめた結果 (同じ日に 1 つでも失敗があれば失敗、成功があれば成功とする)
+type dailyStreak struct {
+	Date      string
+	Failed    bool
+	Succeeded bool
+}
+
+func (d *dailyStreak) day() string {
+	switch {
+	case d.Failed:
+		return StreakDayFailed
+	case d.Succeeded:
+		return StreakDaySuccess
+	}
+	return StreakDaySkipped
+}
+
+// 新しい日から順に数える
+type streakCounter struct {
+	streak StreakResp
+	run    int
+	broken bool
+}
+
+func (s *streakCounter) add(day string) {
+	switch day {
+	case StreakDaySuccess:
+		s.run++
+		if s.run > s.streak.Longest {
+			s.streak.Longest = s.run
+		}
+		if !s.broken {
+			s.streak.Current = s.run
+		}
+	case StreakDayFailed:
+		s.broken = true
+		s.run = 0
+	}
+}
+
+// 今続いている連続成功日数と、これまでで最長の連続成功日数を返す (days は新しい順)
+func computeStreak(days []string) StreakResp {
+	var counter streakCounter
+	for _, day := range days {
+		counter.add(day)
+	}
+	return counter.streak
+}
+
+func isStreakMilestone(days int) bool {
+	for _, milestone := range streakMilestones {
+		if days == milestone {
+			return true
+		}
+	}
+	return days > 100 && days%100 == 0
+}
+
+// 日付ごとにまとめて新しい順に読む (currentOnly なら最初の失敗で止めるので Longest は正しくない)
+func streakFromQuery(query *gorm.DB, currentOnly bool) (StreakResp, error) {
+	rows, err := query.
+		Select("date, bool_or(NOT success AND COALESCE(outcome, '') NOT IN ?) AS failed, bool_or(success) AS succeeded", []string{OutcomeExcused, OutcomeNoGame}).
+		Group("date").
+		Order("date DESC").
+		Rows()
+	if err != nil {
+		return StreakResp{}, err
+	}
+	defer rows.Close()
+
+	var counter streakCounter
+	for rows.Next() {
+		var d dailyStreak
+		if err := rows.Scan(&d.Date, &d.Failed, &d.Succeeded); err != nil {
+			return StreakResp{}, err
+		}
+		counter.add(d.day())
+		if currentOnly && counter.broken {
+			break
+		}
+	}
+	return counter.streak, rows.Err()
+}
+
+// groupId が 0 なら全てのグループを合わせた連続記録を返す
+func getMemberStreak(app *App, userId, groupId uint) (StreakResp, error) {
+	return streakFromQuery(statsQuery(app, userId, groupId), false)
+}
+
+// グループの全員が成功した日が何日続いているか
+func getGroupStreak(app *App, groupId uint) (StreakResp, error) {
+	return streakFromQuery(app.db.Model(&Statistics{}).Where("group_id = ?", groupId), false)
+}
+
+// ゲームの終了後に、節目の日数に達した連続記録を知らせる
+func emitStreakMilestones(app *App, groupId uint, users []uint) {
+	for _, userId := range users {
+		streak, err := streakFromQuery(statsQuery(app, userId, groupId), true)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if !isStreakMilestone(streak.Current) {
+			continue
+		}
+
+		var user Member
+		if err := app.db.First(&user, userId).Error; err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := recordGroupActivity(app.db, groupId, ActivityStreakMilestone, userId, 0, map[string]interface{}{
+			"days": streak.Current,
+		}); err != nil {
+			log.Error(err)
+		}
+		emitGroupEvent(app, groupId, WebhookEventStreakMilestone, map[string]interface{}{
+			"userName": user.UserName,
+			"days":     streak.Current,
+		})
+	}
+
+	streak, err := streakFromQuery(app.db.Model(&Statistics{}).Where("group_id = ?", groupId), true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !isStreakMilestone(streak.Current) {
+		return
+	}
+	if err := recordGroupActivity(app.db, groupId, ActivityStreakMilestone, 0, 0, map[string]interface{}{
+		"days": streak.Current,
+	}); err != nil {
+		log.Error(err)
+	}
+	emitGroupEvent(app, groupId, WebhookEventStreakMilestone, map[string]interface{}{
+		"days": streak.Current,
+	})
+}
@@ -0,0 +1,120 @@
+package be
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func Test_dailyStreak_day(t *testing.T) {
+	testcases := []struct {
+		name   string
+		daily  dailyStreak
+		result string
+	}{
+		{name: "success", daily: dailyStreak{Succeeded: true}, result: StreakDaySuccess},
+		// 同じ日に 1 人でも失敗していれば失敗
+		{name: "success and failure", daily: dailyStreak{Failed: true, Succeeded: true}, result: StreakDayFailed},
+		{name: "failure", daily: dailyStreak{Failed: true}, result: StreakDayFailed},
+		{name: "excused or no game", daily: dailyStreak{}, result: StreakDaySkipped},
+	}
+
+	for _, testcase := range testcases {
+		result := testcase.daily.day()
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
+
+func Test_computeStreak(t *testing.T) {
+	s, f, k := StreakDaySuccess, StreakDayFailed, StreakDaySkipped
+	testcases := []struct {
+		name   string
+		days   []string
+		result StreakResp
+	}{
+		{name: "no records", days: []string{}, result: StreakResp{}},
+		{name: "all success", days: []string{s, s, s}, result: StreakResp{Current: 3, Longest: 3}},
+		{name: "ends with failure", days: []string{f, s, s}, result: StreakResp{Current: 0, Longest: 2}},
+		{name: "longest in the past", days: []string{s, f, s, s, s}, result: StreakResp{Current: 1, Longest: 3}},
+		{name: "skip keeps streak", days: []string{k, s, k, s}, result: StreakResp{Current: 2, Longest: 2}},
+		{name: "only skips", days: []string{k, k}, result: StreakResp{}},
+	}
+
+	for _, testcase := range testcases {
+		result := computeStreak(testcase.days)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%+v, actual=%+v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
+
+func Test_isStreakMilestone(t *testing.T) {
+	testcases := []struct {
+		days   int
+		result bool
+	}{
+		{days: 0, result: false},
+		{days: 1, result: false},
+		{days: 3, result: true},
+		{days: 7, result: true},
+		{days: 8, result: false},
+		{days: 100, result: true},
+		{days: 150, result: false},
+		{days: 300, result: true},
+	}
+
+	for _, testcase := range testcases {
+		result := isStreakMilestone(testcase.days)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %v: expected=%v, actual=%v\n", testcase.days, testcase.result, result)
+		}
+	}
+}
+
+func Test_streakFromQuery(t *testing.T) {
+	if db == nil {
+		t.Skip()
+	}
+
+	if err := db.Migrator().DropTable(&Statistics{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(&Statistics{}); err != nil {
+		t.Fatal(err)
+	}
+	stats := []Statistics{
+		{UserId: 1, GroupId: 1, Date: "2022-03-01", Outcome: OutcomeSuccess, Success: true},
+		{UserId: 1, GroupId: 1, Date: "2022-03-02", Outcome: OutcomeSuccess, Success: true},
+		{UserId: 2, GroupId: 1, Date: "2022-03-02", Outcome: OutcomeAbsent},
+		{UserId: 1, GroupId: 1, Date: "2022-03-03", Outcome: OutcomeExcused},
+		{UserId: 1, GroupId: 1, Date: "2022-03-04", Outcome: OutcomeSuccess, Success: true},
+		{UserId: 2, GroupId: 1, Date: "2022-03-04", Outcome: OutcomeNoGame},
+	}
+	if err := db.Create(&stats).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{db: db}
+	testcases := []struct {
+		name        string
+		query       *gorm.DB
+		currentOnly bool
+		result      StreakResp
+	}{
+		{name: "member", query: statsQuery(app, 1, 1), result: StreakResp{Current: 3, Longest: 3}},
+		{name: "group", query: db.Model(&Statistics{}).Where("group_id = ?", 1), result: StreakResp{Current: 1, Longest: 1}},
+		{name: "group current only", query: db.Model(&Statistics{}).Where("group_id = ?", 1), currentOnly: true, result: StreakResp{Current: 1, Longest: 1}},
+		{name: "no records", query: statsQuery(app, 3, 0), result: StreakResp{}},
+	}
+	for _, testcase := range testcases {
+		result, err := streakFromQuery(testcase.query, testcase.currentOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%+v, actual=%+v\n", testcase.name, testcase.result, result)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package be
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ErrMsgTooManyAttempts = "ログインの試行回数が多すぎます。しばらく待ってからやり直してください"
+)
+
+const (
+	ThrottleKindUser = "user"
+	ThrottleKindIp   = "ip"
+)
+
+const (
+	AuditEventLoginFailed    = "login_failed"
+	AuditEventLoginLocked    = "login_locked"
+	AuditEventLoginSucceeded = "login_succeeded"
+)
+
+const (
+	// ロックされずに失敗できる回数
+	LoginFreeAttemptsPerUser = 5
+	LoginFreeAttemptsPerIp   = 20
+	LoginBaseLockout         = 30 * time.Second
+	LoginMaxLockout          = time.Hour
+	// 最後の失敗からこの時間が経てば失敗回数を忘れる
+	LoginFailureMemory = 24 * time.Hour
+)
+
+type LoginThrottle struct {
+	gorm.Model
+	Kind          string `gorm:"uniqueIndex:idx_login_throttle"`
+	Key           string `gorm:"uniqueIndex:idx_login_throttle"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+type AuditLog struct {
+	gorm.Model
+	UserId uint `gorm:"index"`
+	Event  string
+	Ip     string
+	Detail string
+}
+
+// 失敗回数に応じたロック時間 (指数的に伸ばす)
+func loginLockDuration(failures, freeAttempts int) time.Duration {
+	if failures < freeAttempts {
+		return 0
+	}
+	lock := LoginBaseLockout
+	for i := freeAttempts; i < failures; i++ {
+		lock *= 2
+		if lock >= LoginMaxLockout {
+			return LoginMaxLockout
+		}
+	}
+	return lock
+}
+
+// 行をロックして取得する (なければ作る)
+// 同時に送られたリクエストが確認と記録の間に割り込まないように、同じトランザクションで失敗を記録する
+func lockLoginThrottle(tx *gorm.DB, kind, key string) (LoginThrottle, error) {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginThrottle{Kind: kind, Key: key}).Error; err != nil {
+		return LoginThrottle{}, err
+	}
+	var throttle LoginThrottle
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&throttle, "kind = ? AND key = ?", kind, key).Error; err != nil {
+		return LoginThrottle{}, err
+	}
+	return throttle, nil
+}
+
+// アカウント (userId が 0 なら存在しないので確認しない) か IP アドレスがロックされていれば
+// あと何秒待てばよいかを返す
+func loginRetryAfter(tx *gorm.DB, userId uint, userName, ip string, now time.Time) (time.Duration, error) {
+	keys := map[string]string{ThrottleKindIp: ip}
+	if userId != 0 {
+		keys[ThrottleKindUser] = userName
+	}
+
+	var retryAfter time.Duration
+	// ロックを取る順番をそろえる
+	for _, kind := range []string{ThrottleKindUser, ThrottleKindIp} {
+		key, ok := keys[kind]
+		if !ok {
+			continue
+		}
+		throttle, err := lockLoginThrottle(tx, kind, key)
+		if err != nil {
+			return 0, err
+		}
+		if now.Before(throttle.LockedUntil) && throttle.LockedUntil.Sub(now) > retryAfter {
+			retryAfter = throttle.LockedUntil.Sub(now)
+		}
+	}
+	return retryAfter, nil
+}
+
+// 失敗を記録し、必要ならロックする (ロックした場合は true)
+func recordLoginFailure(tx *gorm.DB, kind, key string, freeAttempts int, now time.Time) (bool, error) {
+	throttle, err := lockLoginThrottle(tx, kind, key)
+	if err != nil {
+		return false, err
+	}
+
+	if now.Sub(throttle.LastFailureAt) > LoginFailureMemory {
+		throttle.Failures = 0
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+
+	lock := loginLockDuration(throttle.Failures, freeAttempts)
+	if lock > 0 {
+		throttle.LockedUntil = now.Add(lock)
+	}
+	if err := tx.Save(&throttle).Error; err != nil {
+		return false, err
+	}
+	return lock > 0, nil
+}
+
+func resetLoginFailures(tx *gorm.DB, kind, key string) error {
+	return tx.Model(&LoginThrottle{}).Where("kind = ? AND key = ?", kind, key).Updates(map[string]interface{}{
+		"failures":     0,
+		"locked_until": time.Time{},
+	}).Error
+}
+
+// ログインの失敗をアカウントと IP アドレスの両方に記録する
+// 存在しないユーザー名の行は作らない (userId が 0 なら IP アドレスだけに記録する)
+func recordFailedLogin(tx *gorm.DB, userId uint, userName, ip string, now time.Time) error {
+	lockedUser := false
+	if userId != 0 {
+		var err error
+		if lockedUser, err = recordLoginFailure(tx, ThrottleKindUser, userName, LoginFreeAttemptsPerUser, now); err != nil {
+			return err
+		}
+	}
+	lockedIp, err := recordLoginFailure(tx, ThrottleKindIp, ip, LoginFreeAttemptsPerIp, now)
+	if err != nil {
+		return err
+	}
+
+	if err := recordAudit(tx, userId, AuditEventLoginFailed, ip, userName); err != nil {
+		return err
+	}
+	if lockedUser || lockedIp {
+		log.WithField("userName", userName).WithField("ip", ip).Warn("Login locked")
+		return recordAudit(tx, userId, AuditEventLoginLocked, ip, userName)
+	}
+	return nil
+}
+
+func recordAudit(tx *gorm.DB, userId uint, event, ip, detail string) error {
+	return tx.Create(&AuditLog{UserId: userId, Event: event, Ip: ip, Detail: detail}).Error
+}
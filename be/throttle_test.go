@@ -0,0 +1,48 @@
+package be
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_loginLockDuration(t *testing.T) {
+	testcases := []struct {
+		name     string
+		failures int
+		result   time.Duration
+	}{
+		{
+			name:     "first failure",
+			failures: 1,
+			result:   0,
+		},
+		{
+			name:     "just before lock",
+			failures: 4,
+			result:   0,
+		},
+		{
+			name:     "first lock",
+			failures: 5,
+			result:   30 * time.Second,
+		},
+		{
+			name:     "doubled",
+			failures: 7,
+			result:   2 * time.Minute,
+		},
+		{
+			name:     "capped",
+			failures: 30,
+			result:   LoginMaxLockout,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			result := loginLockDuration(testcase.failures, 5)
+			if result != testcase.result {
+				t.Errorf("Unexpected result for %v: expected=%v, actual=%v\n", testcase.failures, testcase.result, result)
+			}
+		})
+	}
+}
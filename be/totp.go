@@ -0,0 +1,367 @@
+package be
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgTotpCode    = "確認コードが正しくありません"
+	ErrMsgTotpExpired = "時間が経ちすぎました。もう一度ログインしてください"
+)
+
+const (
+	TotpIssuer = "おはとり"
+	TotpDigits = 6
+	TotpPeriod = 30
+	// 時計のずれを許容するステップ数
+	TotpSkew          = 1
+	TotpSecretSize    = 20
+	RecoveryCodeCount = 10
+	// パスワードを確認してから確認コードを入力するまでの期限
+	TotpPendingValid = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type RecoveryCode struct {
+	gorm.Model
+	UserId   uint `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+// RFC 6238 の確認コードを計算する
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TotpDigits, value%uint32(math.Pow10(TotpDigits)))
+}
+
+// コードが正しければそのステップを返す (lastStep 以前のコードは再利用とみなして拒否する)
+func verifyTotp(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / TotpPeriod
+	for step := current - TotpSkew; step <= current+TotpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpUri(userName, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TotpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(TotpDigits))
+	params.Set("period", strconv.Itoa(TotpPeriod))
+	label := url.PathEscape(TotpIssuer + ":" + userName)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// 未使用の回復コードであれば使用済みにする
+func useRecoveryCode(tx *gorm.DB, userId uint, code string) (bool, error) {
+	result := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected != 0, nil
+}
+
+func handleEnrollTotp(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if user.TotpEnabled {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	key := make([]byte, TotpSecretSize)
+	if _, err := rand.Read(key); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	// 確認コードが送られてくるまでは有効にしない
+	if err := app.db.Model(&Member{}).Where(userId).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"secret": secret,
+		"uri":    totpUri(user.UserName, secret),
+	})
+}
+
+func handleConfirmTotp(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if user.TotpEnabled || user.TotpSecret == "" {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	step, ok := verifyTotp(user.TotpSecret, c.PostForm("code"), time.Now(), 0)
+	if !ok {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTotpCode,
+		})
+		return
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Member{}).Where(userId).Updates(map[string]interface{}{"totp_enabled": true, "totp_last_step": step}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for i := 0; i < RecoveryCodeCount; i++ {
+			code, err := generateRecoveryCode()
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&RecoveryCode{UserId: userId, CodeHash: hashToken(normalizeRecoveryCode(code))}).Error; err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// 回復コードは平文ではここでしか返さない
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"recoveryCodes": codes,
+	})
+}
+
+func handleDisableTotp(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if reason := confirmIdentity(c, &user, c.PostForm("password")); reason != "" {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  reason,
+		})
+		return
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Member{}).Where(userId).Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// パスワードの確認が済んだセッションで確認コードか回復コードを受け付ける
+func handleLoginTotp(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("pending_user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+	ip := c.ClientIP()
+	now := time.Now()
+
+	pendingAt, _ := sess.Get("pending_at").(int64)
+	if now.Sub(time.Unix(pendingAt, 0)) > TotpPendingValid {
+		sess.Delete("pending_user_id")
+		sess.Delete("pending_at")
+		if err := sess.Save(); err != nil {
+			log.Error(err)
+		}
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success":       false,
+			"reason":        ErrMsgTotpExpired,
+			"loginRequired": true,
+		})
+		return
+	}
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var retryAfter time.Duration
+	verified := false
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if retryAfter, err = loginRetryAfter(tx, userId, user.UserName, ip, now); err != nil || retryAfter > 0 {
+			return err
+		}
+
+		if code, ok := c.GetPostForm("recoveryCode"); ok {
+			used, err := useRecoveryCode(tx, userId, code)
+			if err != nil {
+				return err
+			}
+			verified = used
+		} else if step, ok := verifyTotp(user.TotpSecret, c.PostForm("code"), now, user.TotpLastStep); ok {
+			// 同じコードを二度使えないようにする
+			result := tx.Model(&Member{}).Where("id = ? AND totp_last_step < ?", userId, step).Update("totp_last_step", step)
+			if result.Error != nil {
+				return result.Error
+			}
+			verified = result.RowsAffected != 0
+		}
+
+		if !verified {
+			return recordFailedLogin(tx, userId, user.UserName, ip, now)
+		}
+		if err := resetLoginFailures(tx, ThrottleKindUser, user.UserName); err != nil {
+			return err
+		}
+		return recordAudit(tx, userId, AuditEventLoginSucceeded, ip, "totp")
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTooManyAttempts,
+		})
+		return
+	}
+	if !verified {
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTotpCode,
+		})
+		return
+	}
+
+	if err := startSession(app, c, userId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,108 @@
+package be
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func Test_totpCode(t *testing.T) {
+	// RFC 6238 Appendix B の SHA1 のテストベクタ (下 6 桁)
+	secret := []byte("12345678901234567890")
+	testcases := []struct {
+		name     string
+		unix     int64
+		expected string
+	}{
+		{"59", 59, "287082"},
+		{"1111111109", 1111111109, "081804"},
+		{"1111111111", 1111111111, "050471"},
+		{"1234567890", 1234567890, "005924"},
+		{"2000000000", 2000000000, "279037"},
+		{"20000000000", 20000000000, "353130"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := totpCode(secret, tc.unix/TotpPeriod)
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_verifyTotp(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / TotpPeriod
+
+	testcases := []struct {
+		name     string
+		code     string
+		lastStep int64
+		expected bool
+	}{
+		{"current", "081804", 0, true},
+		{"previous step", totpCode([]byte("12345678901234567890"), step-1), 0, true},
+		{"too old", totpCode([]byte("12345678901234567890"), step-2), 0, false},
+		{"reused", "081804", step, false},
+		{"wrong", "000000", 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, actual := verifyTotp(secret, tc.code, now, tc.lastStep)
+			if actual != tc.expected {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_normalizeRecoveryCode(t *testing.T) {
+	code, err := generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 11 || code[5] != '-' {
+		t.Errorf("Unexpected recovery code format: %v", code)
+	}
+	if normalizeRecoveryCode(" "+code+" ") != normalizeRecoveryCode(code[:5]+code[6:]) {
+		t.Errorf("Recovery code is not normalized: %v", code)
+	}
+}
+
+func Test_handleLoginTotpExpired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("session", cookie.NewStore([]byte("secret"))))
+	r.POST("/", func(c *gin.Context) {
+		sess := sessions.Default(c)
+		sess.Set("pending_user_id", uint(1))
+		sess.Set("pending_at", time.Now().Add(-TotpPendingValid-time.Second).Unix())
+		// 期限切れならデータベースに触れる前に断る
+		handleLoginTotp(&App{}, c)
+		if sess.Get("pending_user_id") != nil {
+			t.Errorf("Pending session is not cleared")
+		}
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	var resp struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusUnauthorized || resp.Reason != ErrMsgTotpExpired {
+		t.Errorf("Unexpected result: expected=(%v, %v), actual=(%v, %v)\n", http.StatusUnauthorized, ErrMsgTotpExpired, w.Code, resp.Reason)
+	}
+}
@@ -2,14 +2,18 @@ package be
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 const (
@@ -49,14 +53,14 @@ func isValidPassword(password string) bool {
 }
 
 func registerUser(app *App, userName, password string) (uint, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashed, err := hashPassword(password)
 	if err != nil {
 		return 0, err
 	}
 
 	member := Member{
 		UserName: userName,
-		Password: string(hashed),
+		Password: hashed,
 	}
 
 	if err := app.db.Create(&member).Error; err != nil {
@@ -94,9 +98,11 @@ func handleRegisterUser(app *App, c *gin.Context) {
 		return
 	}
 
-	sess := sessions.Default(c)
-	sess.Set("user_id", userId)
-	sess.Save()
+	if err := startSession(app, c, userId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
 	c.JSON(http.StatusOK, map[string]interface{}{
 		"success": true,
@@ -107,31 +113,205 @@ func handleLogin(app *App, c *gin.Context) {
 	var member Member
 	userName := c.PostForm("userName")
 	password := c.PostForm("password")
-	if err := app.db.First(&member, "user_name = ?", userName).Error; err != nil {
+	ip := c.ClientIP()
+	now := time.Now()
+
+	var retryAfter time.Duration
+	authenticated := false
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&member, "user_name = ?", userName).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// アカウントか IP アドレスがロックされている間はパスワードを確認しない
+		var err error
+		if retryAfter, err = loginRetryAfter(tx, member.ID, userName, ip, now); err != nil || retryAfter > 0 {
+			return err
+		}
+		if member.ID == 0 || bcrypt.CompareHashAndPassword([]byte(member.Password), []byte(password)) != nil {
+			return recordFailedLogin(tx, member.ID, userName, ip, now)
+		}
+		authenticated = true
+		return nil
+	})
+	if err != nil {
 		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgTooManyAttempts,
+		})
+		return
+	}
+	if !authenticated {
 		c.Status(http.StatusUnauthorized)
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(member.Password), []byte(password)); err != nil {
+
+	if member.TotpEnabled {
+		// 確認コードを受け取るまではログインさせない
+		if err := startPendingSession(c, member.ID); err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"totpRequired": true,
+		})
+		return
+	}
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if err := resetLoginFailures(tx, ThrottleKindUser, userName); err != nil {
+			return err
+		}
+		return recordAudit(tx, member.ID, AuditEventLoginSucceeded, ip, "")
+	})
+	if err != nil {
 		log.Error(err)
-		c.Status(http.StatusUnauthorized)
+	}
+
+	if err := startSession(app, c, member.ID); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	sess := sessions.Default(c)
-	sess.Set("user_id", member.ID)
-	sess.Save()
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"totpRequired": false,
+	})
 }
 
 type GroupInfoResp struct {
-	Members    []string `json:"members"`
-	WakeUpTime string   `json:"wakeUpTime"`
+	Id          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	MaxMembers  int      `json:"maxMembers"`
+	Members     []string `json:"members"`
+	// Members と同じ順番
+	Profiles   []PlayerProfile `json:"profiles"`
+	WakeUpTime string          `json:"wakeUpTime"`
+	// このグループでの成功率
+	SuccessRate int `json:"successRate"`
+	// このグループでの自分の連続記録と、全員が成功した日の連続記録
+	Streak      StreakResp `json:"streak"`
+	GroupStreak StreakResp `json:"groupStreak"`
+	// 自分の権限と、他のメンバーのユーザー名ごとの権限
+	Role  string            `json:"role"`
+	Roles map[string]string `json:"roles"`
+}
+
+type MailSettingsResp struct {
+	Invitation bool `json:"invitation"`
+	Reminder   bool `json:"reminder"`
+	Digest     bool `json:"digest"`
 }
 
 type UserInfoResp struct {
-	UserName    string        `json:"userName"`
-	JoinedGroup bool          `json:"joinedGroup"`
-	GroupInfo   GroupInfoResp `json:"groupInfo"`
-	SuccessRate int           `json:"successRate"`
+	UserName      string           `json:"userName"`
+	Email         string           `json:"email"`
+	EmailVerified bool             `json:"emailVerified"`
+	MailSettings  MailSettingsResp `json:"mailSettings"`
+	TotpEnabled   bool             `json:"totpEnabled"`
+	DisplayName   string           `json:"displayName"`
+	Bio           string           `json:"bio"`
+	AvatarUrl     string           `json:"avatarUrl"`
+	JoinedGroup   bool             `json:"joinedGroup"`
+	// 最初に参加したグループ (Groups の先頭と同じ)
+	GroupInfo           GroupInfoResp   `json:"groupInfo"`
+	Groups              []GroupInfoResp `json:"groups"`
+	SuccessRate         int             `json:"successRate"`
+	Streak              StreakResp      `json:"streak"`
+	DeletionScheduledAt *time.Time      `json:"deletionScheduledAt,omitempty"`
+}
+
+// UTC で保存されている起床時刻を日本時間の "15:04" 形式にする
+func localWakeUpTime(savedTime string) (string, error) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return "", err
+	}
+
+	wakeUpTime, err := time.Parse("15:04", savedTime)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().In(jst)
+	wakeUpTime = time.Date(now.Year(), now.Month(), now.Day(), wakeUpTime.Hour(), wakeUpTime.Minute(), 0, 0, time.UTC).In(jst)
+
+	return fmt.Sprintf("%02d:%02d", wakeUpTime.Hour(), wakeUpTime.Minute()), nil
+}
+
+func getGroupInfo(app *App, userId, groupId uint) (*GroupInfoResp, error) {
+	groupInfo := GroupInfoResp{
+		Id:       groupId,
+		Members:  make([]string, 0),
+		Profiles: make([]PlayerProfile, 0),
+		Roles:    make(map[string]string),
+	}
+
+	var group Group
+	if err := app.db.First(&group, groupId).Error; err != nil {
+		return nil, err
+	}
+
+	groupInfo.Name = group.Name
+	groupInfo.Description = group.Description
+	groupInfo.MaxMembers = group.MaxMembers
+
+	wakeUpTime, err := localWakeUpTime(group.WakeUpTime)
+	if err != nil {
+		return nil, err
+	}
+	groupInfo.WakeUpTime = wakeUpTime
+
+	groupMembers, err := getGroupMembers(app.db, groupId)
+	if err != nil {
+		return nil, err
+	}
+	memberIds := make([]uint, 0)
+	for _, memb := range groupMembers {
+		memberIds = append(memberIds, memb.ID)
+	}
+	memberProfiles, err := getProfiles(app.db, memberIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var memberships []GroupMembership
+	if err := app.db.Find(&memberships, "group_id = ?", groupId).Error; err != nil {
+		return nil, err
+	}
+	roles := make(map[uint]string)
+	for _, membership := range memberships {
+		roles[membership.UserId] = membership.Role
+	}
+
+	for i, memb := range groupMembers {
+		if memb.ID != userId {
+			groupInfo.Members = append(groupInfo.Members, memb.UserName)
+			groupInfo.Profiles = append(groupInfo.Profiles, makePlayerProfile(&groupMembers[i], memberProfiles[memb.ID]))
+			groupInfo.Roles[memb.UserName] = roles[memb.ID]
+		} else {
+			groupInfo.Role = roles[memb.ID]
+		}
+	}
+
+	if groupInfo.SuccessRate, err = getSuccessRate(app, userId, groupId); err != nil {
+		return nil, err
+	}
+	if groupInfo.Streak, err = getMemberStreak(app, userId, groupId); err != nil {
+		return nil, err
+	}
+	if groupInfo.GroupStreak, err = getGroupStreak(app, groupId); err != nil {
+		return nil, err
+	}
+	return &groupInfo, nil
 }
 
 func handleGetUserInfo(app *App, c *gin.Context) {
@@ -153,82 +333,74 @@ func handleGetUserInfo(app *App, c *gin.Context) {
 		return
 	}
 
-	// 成功率を計算
-	daysAfterSignUp, err := getDaysAfterSignUp(app, userId)
+	// 全てのグループを合わせた成功率
+	successRate, err := getSuccessRate(app, userId, 0)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	successCount, err := getSuccessCount(app, userId)
+
+	// 全てのグループを合わせた連続記録
+	streak, err := getMemberStreak(app, userId, 0)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	failureCount, err := getFailureCount(app, userId)
+
+	groupIds, err := getGroupIds(app.db, userId)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	nTrial := successCount + failureCount
-	if nTrial < daysAfterSignUp {
-		nTrial = daysAfterSignUp
+	userInfo := UserInfoResp{
+		UserName:      user.UserName,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		MailSettings: MailSettingsResp{
+			Invitation: user.MailInvitation,
+			Reminder:   user.MailReminder,
+			Digest:     user.MailDigest,
+		},
+		TotpEnabled:         user.TotpEnabled,
+		JoinedGroup:         len(groupIds) != 0,
+		SuccessRate:         successRate,
+		Streak:              streak,
+		DeletionScheduledAt: user.DeletionScheduledAt,
 	}
 
-	var successRate int
-	if nTrial == 0 {
-		successRate = 100
-	} else {
-		successRate = successCount * 100 / nTrial
+	profiles, err := getProfiles(app.db, []uint{userId})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
-
-	userInfo := UserInfoResp{
-		UserName:    user.UserName,
-		JoinedGroup: user.GroupId != 0,
-		SuccessRate: successRate,
+	player := makePlayerProfile(&user, profiles[userId])
+	userInfo.DisplayName = player.DisplayName
+	userInfo.AvatarUrl = player.AvatarUrl
+	if profile, ok := profiles[userId]; ok {
+		userInfo.Bio = profile.Bio
 	}
 
-	userInfo.GroupInfo.Members = make([]string, 0)
-	if user.GroupId != 0 {
-		var group Group
-		if err := app.db.First(&group, user.GroupId).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
-		jst, err := time.LoadLocation("Asia/Tokyo")
-		if err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
-		wakeUpTime, err := time.Parse("15:04", group.WakeUpTime)
+	userInfo.Groups = make([]GroupInfoResp, 0)
+	for _, groupId := range groupIds {
+		groupInfo, err := getGroupInfo(app, userId, groupId)
 		if err != nil {
 			log.Error(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-		now := time.Now().In(jst)
-		wakeUpTime = time.Date(now.Year(), now.Month(), now.Day(), wakeUpTime.Hour(), wakeUpTime.Minute(), 0, 0, time.UTC).In(jst)
-
-		userInfo.GroupInfo.WakeUpTime = fmt.Sprintf("%02d:%02d", wakeUpTime.Hour(), wakeUpTime.Minute())
-
-		var groupMembers []Member
-		if err := app.db.Find(&groupMembers, "group_id = ?", user.GroupId).Error; err != nil {
-			log.Error(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		for _, memb := range groupMembers {
-			if memb.ID != userId {
-				userInfo.GroupInfo.Members = append(userInfo.GroupInfo.Members, memb.UserName)
-			}
-		}
+		userInfo.Groups = append(userInfo.Groups, *groupInfo)
+	}
+	if len(userInfo.Groups) != 0 {
+		userInfo.GroupInfo = userInfo.Groups[0]
+	} else {
+		userInfo.GroupInfo.Members = make([]string, 0)
+		userInfo.GroupInfo.Profiles = make([]PlayerProfile, 0)
+		userInfo.GroupInfo.Roles = make(map[string]string)
 	}
 
 	c.JSON(http.StatusOK, &userInfo)
@@ -292,45 +464,57 @@ func handleGetStatistics(app *App, c *gin.Context) {
 		return
 	}
 
+	// groupId を指定した場合はそのグループの記録だけを返す
+	var groupId uint
+	if c.Query("groupId") != "" {
+		if groupId, err = getGroupId(app, c, userId); err != nil {
+			c.AbortWithStatus(http.StatusNotAcceptable)
+			return
+		}
+	}
+	wakeUpGroupId := groupId
+	if wakeUpGroupId == 0 {
+		groupIds, err := getGroupIds(app.db, userId)
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if len(groupIds) != 0 {
+			wakeUpGroupId = groupIds[0]
+		}
+	}
+
+	// 直近の記録だけを取得する
+	now := time.Now().In(jst)
+	since := now.AddDate(0, 0, -StatisticsRecentDays).Format(StatDateFormat)
 	var statsData []Statistics
-	if err := app.db.Where("user_id = ?", user.ID).Order("created_at").Limit(7).Find(&statsData).Error; err != nil {
+	if err := statsQuery(app, user.ID, groupId).Where("date >= ?", since).Order("date").Find(&statsData).Error; err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	for _, s := range statsData {
-		log.Println(s.CreatedAt.In(jst))
-	}
-
-	now := time.Now().In(jst)
 	var wakeUpTime time.Time
-	if user.GroupId == 0 {
+	if wakeUpGroupId == 0 {
 		wakeUpTime = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, jst)
 	} else {
 		var group Group
-		if err := app.db.First(&group, user.GroupId).Error; err != nil {
+		if err := app.db.First(&group, wakeUpGroupId).Error; err != nil {
 			log.Error(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-		savedTime, err := time.Parse("15:04", group.WakeUpTime)
+		startTime, err := startTimeOnDate(group.WakeUpTime, now, jst)
 		if err != nil {
 			log.Error(err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-		wakeUpTime = time.Date(now.Year(), now.Month(), now.Day(), savedTime.Hour(), savedTime.Minute(), 0, 0, time.UTC).In(jst)
-		//TODO: 雑すぎるのでなんとかする
-		if wakeUpTime.Day() != now.Day() {
-			wakeUpTime = time.Date(now.Year(), now.Month(), now.Day()+1, savedTime.Hour(), savedTime.Minute(), 0, 0, time.UTC).In(jst)
-		}
-		if wakeUpTime.Day() != now.Day() {
-			wakeUpTime = time.Date(now.Year(), now.Month(), now.Day()-1, savedTime.Hour(), savedTime.Minute(), 0, 0, time.UTC).In(jst)
-		}
+		wakeUpTime = startTime
 	}
 
-	statistics := collectStats(statsData, wakeUpTime, user.CreatedAt, now, jst)
+	statistics := collectStats(statsData, wakeUpTime, user.CreatedAt, now, jst, StatisticsRecentDays)
 
 	jsonData, err := json.Marshal(&statistics)
 	if err != nil {
@@ -0,0 +1,675 @@
+package be
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	ErrMsgPasskey = "パスキーを確認できませんでした"
+)
+
+const (
+	WebAuthnRpName  = "おはとり"
+	WebAuthnTimeout = 5 * time.Minute
+)
+
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttested     = 0x40
+)
+
+var (
+	ErrWebAuthnClientData = errors.New("webauthn: client data mismatch")
+	ErrWebAuthnAuthData   = errors.New("webauthn: invalid authenticator data")
+	ErrWebAuthnPublicKey  = errors.New("webauthn: unsupported public key")
+	ErrWebAuthnSignature  = errors.New("webauthn: invalid signature")
+	ErrWebAuthnSignCount  = errors.New("webauthn: sign count did not increase")
+	ErrWebAuthnChallenge  = errors.New("webauthn: challenge expired")
+)
+
+// 登録されたパスキー (CredentialId は base64url)
+type PasskeyCredential struct {
+	gorm.Model
+	UserId       uint   `gorm:"index"`
+	CredentialId string `gorm:"unique"`
+	// COSE 形式の公開鍵
+	PublicKey []byte
+	SignCount uint32
+	Name      string
+}
+
+type authenticatorData struct {
+	RpIdHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// RP ID は WEBAUTHN_RP_ID か、アプリの Origin のホスト名
+func webAuthnRelyingParty() (string, error) {
+	if rpId := os.Getenv("WEBAUTHN_RP_ID"); rpId != "" {
+		return rpId, nil
+	}
+	originUrl, err := url.Parse(primaryOrigin())
+	if err != nil {
+		return "", err
+	}
+	return originUrl.Hostname(), nil
+}
+
+func decodeBase64Url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Origin は CSRF の確認と同じく ALLOWED_ORIGINS のどれかであればよい
+func verifyClientData(raw []byte, typ, challenge string) error {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return err
+	}
+	if clientData.Type != typ || !isAllowedOrigin(clientData.Origin) {
+		return ErrWebAuthnClientData
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return ErrWebAuthnClientData
+	}
+	return nil
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, ErrWebAuthnAuthData
+	}
+	ad := &authenticatorData{
+		RpIdHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if ad.Flags&authDataFlagAttested == 0 {
+		return ad, nil
+	}
+
+	// AAGUID (16 バイト) の後に認証情報 ID の長さと ID、公開鍵が続く
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, ErrWebAuthnAuthData
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, ErrWebAuthnAuthData
+	}
+	ad.CredentialId = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, after, err := decodeCbor(rest)
+	if err != nil {
+		return nil, err
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// RP ID と、ユーザーの操作と本人確認が行われたことを確認する
+func checkAuthenticatorData(ad *authenticatorData, rpId string) error {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	if subtle.ConstantTimeCompare(ad.RpIdHash, rpIdHash[:]) != 1 {
+		return ErrWebAuthnAuthData
+	}
+	if ad.Flags&authDataFlagUserPresent == 0 || ad.Flags&authDataFlagUserVerified == 0 {
+		return ErrWebAuthnAuthData
+	}
+	return nil
+}
+
+// ES256 (P-256) と RS256 の COSE 鍵に対応する
+func parseCoseKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, rest, err := decodeCbor(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, 0, ErrWebAuthnPublicKey
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrWebAuthnPublicKey
+		}
+		// 曲線上の点かどうかは crypto/ecdh に検証させる
+		point := append([]byte{4}, append(append([]byte{}, x...), y...)...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, 0, ErrWebAuthnPublicKey
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return pub, alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrWebAuthnPublicKey
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < 2048 || pub.E < 3 {
+			return nil, 0, ErrWebAuthnPublicKey
+		}
+		return pub, alg, nil
+	}
+	return nil, 0, ErrWebAuthnPublicKey
+}
+
+func verifyWebAuthnSignature(pub crypto.PublicKey, alg int64, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+			return ErrWebAuthnSignature
+		}
+		return nil
+	case coseAlgRS256:
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+			return ErrWebAuthnSignature
+		}
+		return nil
+	}
+	return ErrWebAuthnPublicKey
+}
+
+// 登録時の応答を検証する (attestation は要求しないので attStmt は確認しない)
+func verifyRegistration(rpId, challenge string, clientDataJSON, attestationObject []byte) (*authenticatorData, error) {
+	if err := verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnAuthData
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnAuthData
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAuthenticatorData(ad, rpId); err != nil {
+		return nil, err
+	}
+	if ad.CredentialId == nil {
+		return nil, ErrWebAuthnAuthData
+	}
+	if _, _, err := parseCoseKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// ログイン時の応答を検証し、新しい署名カウンタを返す
+func verifyAssertion(rpId, challenge string, publicKey []byte, signCount uint32, clientDataJSON, rawAuthData, signature []byte) (uint32, error) {
+	if err := verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkAuthenticatorData(ad, rpId); err != nil {
+		return 0, err
+	}
+
+	pub, alg, err := parseCoseKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyWebAuthnSignature(pub, alg, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// カウンタを使わない認証器は常に 0 を返す。増えていなければ複製を疑う
+	if (ad.SignCount != 0 || signCount != 0) && ad.SignCount <= signCount {
+		return 0, ErrWebAuthnSignCount
+	}
+	return ad.SignCount, nil
+}
+
+func webAuthnUserHandle(userId uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(userId), 10)))
+}
+
+// チャレンジを生成してセッションに保存する
+func startWebAuthnChallenge(sess sessions.Session) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	sess.Set("webauthn_challenge", challenge)
+	sess.Set("webauthn_expires", time.Now().Add(WebAuthnTimeout).Unix())
+	if err := sess.Save(); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// セッションのチャレンジを取り出す (使い回せないように削除する)
+func popWebAuthnChallenge(sess sessions.Session) (string, error) {
+	challenge, _ := sess.Get("webauthn_challenge").(string)
+	expires, _ := sess.Get("webauthn_expires").(int64)
+	sess.Delete("webauthn_challenge")
+	sess.Delete("webauthn_expires")
+	if err := sess.Save(); err != nil {
+		return "", err
+	}
+	if challenge == "" || time.Now().Unix() > expires {
+		return "", ErrWebAuthnChallenge
+	}
+	return challenge, nil
+}
+
+type PasskeyRegistrationReq struct {
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+type PasskeyAssertionReq struct {
+	Id       string `json:"id"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type PasskeyResp struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func handleBeginPasskeyRegistration(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var user Member
+	if err := app.db.First(&user, userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var credentials []PasskeyCredential
+	if err := app.db.Find(&credentials, "user_id = ?", userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	rpId, err := webAuthnRelyingParty()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	challenge, err := startWebAuthnChallenge(sess)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// 同じ認証器に二重に登録しないようにする
+	exclude := make([]map[string]interface{}, 0)
+	for _, cred := range credentials {
+		exclude = append(exclude, map[string]interface{}{
+			"type": "public-key",
+			"id":   cred.CredentialId,
+		})
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]interface{}{
+			"id":   rpId,
+			"name": WebAuthnRpName,
+		},
+		"user": map[string]interface{}{
+			"id":          webAuthnUserHandle(userId),
+			"name":        user.UserName,
+			"displayName": user.UserName,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"timeout":            WebAuthnTimeout.Milliseconds(),
+	})
+}
+
+func handleFinishPasskeyRegistration(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var req PasskeyRegistrationReq
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	clientDataJSON, err := decodeBase64Url(req.Response.ClientDataJSON)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	attestationObject, err := decodeBase64Url(req.Response.AttestationObject)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := popWebAuthnChallenge(sess)
+	if errors.Is(err, ErrWebAuthnChallenge) {
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	rpId, err := webAuthnRelyingParty()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ad, err := verifyRegistration(rpId, challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		log.WithField("userId", userId).Warn(err)
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	}
+
+	credential := PasskeyCredential{
+		UserId:       userId,
+		CredentialId: base64.RawURLEncoding.EncodeToString(ad.CredentialId),
+		PublicKey:    ad.PublicKey,
+		SignCount:    ad.SignCount,
+		Name:         req.Name,
+	}
+	if err := app.db.Create(&credential).Error; err != nil {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleBeginPasskeyLogin(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+
+	rpId, err := webAuthnRelyingParty()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	challenge, err := startWebAuthnChallenge(sess)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// ユーザー名を入力させずにログインできるよう allowCredentials は空にする
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             rpId,
+		"userVerification": "required",
+		"timeout":          WebAuthnTimeout.Milliseconds(),
+	})
+}
+
+func handleFinishPasskeyLogin(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	ip := c.ClientIP()
+
+	var req PasskeyAssertionReq
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	credentialId, err := decodeBase64Url(req.Id)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	clientDataJSON, err := decodeBase64Url(req.Response.ClientDataJSON)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	rawAuthData, err := decodeBase64Url(req.Response.AuthenticatorData)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	signature, err := decodeBase64Url(req.Response.Signature)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := popWebAuthnChallenge(sess)
+	if errors.Is(err, ErrWebAuthnChallenge) {
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	} else if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var credential PasskeyCredential
+	if err := app.db.First(&credential, "credential_id = ?", base64.RawURLEncoding.EncodeToString(credentialId)).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	}
+	if req.Response.UserHandle != "" && strings.TrimRight(req.Response.UserHandle, "=") != webAuthnUserHandle(credential.UserId) {
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	}
+
+	rpId, err := webAuthnRelyingParty()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	signCount, verifyErr := verifyAssertion(rpId, challenge, credential.PublicKey, credential.SignCount, clientDataJSON, rawAuthData, signature)
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		if verifyErr != nil {
+			return recordAudit(tx, credential.UserId, AuditEventLoginFailed, ip, "passkey")
+		}
+		// 同時に使われても 1 回しか成功しないようにする
+		result := tx.Model(&PasskeyCredential{}).Where("id = ? AND sign_count = ?", credential.ID, credential.SignCount).Update("sign_count", signCount)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			verifyErr = ErrWebAuthnSignCount
+			return nil
+		}
+		return recordAudit(tx, credential.UserId, AuditEventLoginSucceeded, ip, "passkey")
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if verifyErr != nil {
+		log.WithField("userId", credential.UserId).Warn(verifyErr)
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgPasskey,
+		})
+		return
+	}
+
+	if err := startSession(app, c, credential.UserId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func handleGetPasskeys(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	var credentials []PasskeyCredential
+	if err := app.db.Order("created_at").Find(&credentials, "user_id = ?", userId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	passkeysResp := make([]PasskeyResp, 0)
+	for _, cred := range credentials {
+		passkeysResp = append(passkeysResp, PasskeyResp{
+			Id:        cred.CredentialId,
+			Name:      cred.Name,
+			CreatedAt: cred.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, passkeysResp)
+}
+
+func handleDeletePasskey(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	credentialId := c.PostForm("id")
+	if err := app.db.Unscoped().Where("user_id = ? AND credential_id = ?", userId, credentialId).Delete(&PasskeyCredential{}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
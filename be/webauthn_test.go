@@ -0,0 +1,235 @@
+package be
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_decodeCbor(t *testing.T) {
+	// RFC 8949 Appendix A の例
+	testcases := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{"0", "00", int64(0)},
+		{"23", "17", int64(23)},
+		{"1000000", "1a000f4240", int64(1000000)},
+		{"-1", "20", int64(-1)},
+		{"-1000", "3903e7", int64(-1000)},
+		{"bytes", "4401020304", []byte{1, 2, 3, 4}},
+		{"text", "6449455446", "IETF"},
+		{"array", "83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"map", "a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"nested", "a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"true", "f5", true},
+		{"null", "f6", nil},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, _ := hex.DecodeString(tc.input)
+			actual, rest, err := decodeCbor(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rest) != 0 || !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_decodeCbor_invalid(t *testing.T) {
+	testcases := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"truncated bytes", "4401"},
+		{"huge array", "9bffffffffffffffff"},
+		{"indefinite", "9f01ff"},
+		{"bytes key", "a1410102"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, _ := hex.DecodeString(tc.input)
+			if _, _, err := decodeCbor(input); err == nil {
+				t.Errorf("Unexpected success for %s", tc.name)
+			}
+		})
+	}
+}
+
+// テスト用の最小限の CBOR エンコーダ
+func encodeCborHead(major byte, val uint64) []byte {
+	switch {
+	case val < 24:
+		return []byte{major<<5 | byte(val)}
+	case val < 256:
+		return []byte{major<<5 | 24, byte(val)}
+	default:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(val))
+		return b
+	}
+}
+
+func encodeCbor(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return encodeCborHead(1, uint64(-1-v))
+		}
+		return encodeCborHead(0, uint64(v))
+	case []byte:
+		return append(encodeCborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(encodeCborHead(3, uint64(len(v))), v...)
+	case [][2]interface{}:
+		b := encodeCborHead(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCbor(kv[0])...)
+			b = append(b, encodeCbor(kv[1])...)
+		}
+		return b
+	}
+	panic("unsupported")
+}
+
+func Test_parseCoseKey_offCurve(t *testing.T) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	x[31], y[31] = 1, 1
+	raw := encodeCbor([][2]interface{}{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})
+	if _, _, err := parseCoseKey(raw); err != ErrWebAuthnPublicKey {
+		t.Errorf("Unexpected result: expected=%v, actual=%v\n", ErrWebAuthnPublicKey, err)
+	}
+}
+
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func (a *testAuthenticator) authData(rpId string, flags byte, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	b := append([]byte{}, rpIdHash[:]...)
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if attested {
+		x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+		y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+		b = append(b, a.credentialId...)
+		b = append(b, encodeCbor([][2]interface{}{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})...)
+	}
+	return b
+}
+
+func clientDataJSON(t *testing.T, typ, challenge, origin string) []byte {
+	b, err := json.Marshal(map[string]interface{}{"type": typ, "challenge": challenge, "origin": origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_webAuthnCeremony(t *testing.T) {
+	const (
+		rpId      = "localhost"
+		origin    = "http://localhost:8000"
+		challenge = "Y2hhbGxlbmdl"
+	)
+	defer os.Setenv("ALLOWED_ORIGINS", os.Getenv("ALLOWED_ORIGINS"))
+	os.Setenv("ALLOWED_ORIGINS", origin+",capacitor://localhost")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &testAuthenticator{key: key, credentialId: []byte("credential")}
+	flags := byte(authDataFlagUserPresent | authDataFlagUserVerified)
+
+	attestationObject := encodeCbor([][2]interface{}{
+		{"fmt", "none"},
+		{"attStmt", [][2]interface{}{}},
+		{"authData", authenticator.authData(rpId, flags|authDataFlagAttested, true)},
+	})
+	ad, err := verifyRegistration(rpId, challenge, clientDataJSON(t, "webauthn.create", challenge, origin), attestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ad.CredentialId, authenticator.credentialId) {
+		t.Errorf("Unexpected credential id: %v", ad.CredentialId)
+	}
+	publicKey := ad.PublicKey
+
+	if _, err := verifyRegistration(rpId, challenge, clientDataJSON(t, "webauthn.create", challenge, "https://evil.example"), attestationObject); err == nil {
+		t.Errorf("Registration for another origin is accepted")
+	}
+	if _, err := verifyRegistration(rpId, challenge, clientDataJSON(t, "webauthn.create", challenge, "capacitor://localhost"), attestationObject); err != nil {
+		t.Errorf("Registration for an allowed origin is rejected: %v", err)
+	}
+
+	sign := func(authData, clientData []byte) []byte {
+		clientDataHash := sha256.Sum256(clientData)
+		digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	testcases := []struct {
+		name      string
+		rpId      string
+		flags     byte
+		challenge string
+		signCount uint32
+		stored    uint32
+		tamper    bool
+		success   bool
+	}{
+		{"success", rpId, flags, challenge, 1, 0, false, true},
+		{"no counter", rpId, flags, challenge, 0, 0, false, true},
+		{"counter not increased", rpId, flags, challenge, 3, 3, false, false},
+		{"wrong challenge", rpId, flags, "b3RoZXI", 1, 0, false, false},
+		{"wrong rp", "example.com", flags, challenge, 1, 0, false, false},
+		{"not verified", rpId, authDataFlagUserPresent, challenge, 1, 0, false, false},
+		{"tampered", rpId, flags, challenge, 1, 0, true, false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			authenticator.signCount = tc.signCount
+			authData := authenticator.authData(tc.rpId, tc.flags, false)
+			clientData := clientDataJSON(t, "webauthn.get", tc.challenge, origin)
+			sig := sign(authData, clientData)
+			if tc.tamper {
+				authData[len(authData)-1]++
+			}
+
+			signCount, err := verifyAssertion(rpId, challenge, publicKey, tc.stored, clientData, authData, sig)
+			if (err == nil) != tc.success {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", tc.name, tc.success, err)
+			}
+			if err == nil && signCount != tc.signCount {
+				t.Errorf("Unexpected sign count for %s: expected=%v, actual=%v\n", tc.name, tc.signCount, signCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package be
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	WebhookFormatSlack   = "slack"
+	WebhookFormatDiscord = "discord"
+	WebhookFormatGeneric = "generic"
+)
+
+const (
+	WebhookEventGameStarted        = "game_started"
+	WebhookEventGameSucceeded      = "game_succeeded"
+	WebhookEventGameFailed         = "game_failed"
+	WebhookEventMemberJoined       = "member_joined"
+	WebhookEventMemberLeft         = "member_left"
+	WebhookEventWakeUpTimeChanged  = "wake_up_time_changed"
+	WebhookEventWakeUpTimeProposed = "wake_up_time_proposed"
+	WebhookEventMemberNudged       = "member_nudged"
+	WebhookEventStreakMilestone    = "streak_milestone"
+)
+
+const (
+	ErrMsgWebhookAddress = "このアドレスには送信できません"
+)
+
+const (
+	WebhookMaxAttempts     = 3
+	WebhookSignatureHeader = "X-Ohatori-Signature"
+	WebhookEventHeader     = "X-Ohatori-Event"
+)
+
+var (
+	webhookClient        = newExternalClient()
+	webhookRetryInterval = 5 * time.Second
+)
+
+var ErrWebhookAddress = errors.New("webhook address is not allowed")
+
+// CGNAT (RFC 6598) の範囲
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// ループバックやプライベートネットワークなど、サーバの内部から届くアドレスには送らない
+func isForbiddenWebhookIp(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+func webhookDialControl(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isForbiddenWebhookIp(ip) {
+		return ErrWebhookAddress
+	}
+	return nil
+}
+
+// 利用者が登録した URL に送るためのクライアント
+// 名前解決の結果が登録後に変わっても内部のアドレスに接続しないように、接続する直前に確認する
+func newExternalClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: webhookDialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// 登録時に名前解決して、内部のアドレスが含まれていないか確認する
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isForbiddenWebhookIp(addr.IP) {
+			return ErrWebhookAddress
+		}
+	}
+	return nil
+}
+
+type Webhook struct {
+	gorm.Model
+	GroupId uint `gorm:"index"`
+	Url     string
+	Format  string
+	Secret  string
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookId  uint `gorm:"index"`
+	Event      string
+	Attempt    int
+	StatusCode int
+	Success    bool
+	Error      string
+}
+
+type WebhookEvent struct {
+	Type    string                 `json:"event"`
+	GroupId uint                   `json:"groupId"`
+	Data    map[string]interface{} `json:"data"`
+	Time    time.Time              `json:"timestamp"`
+}
+
+type WebhookResp struct {
+	Id     uint   `json:"webhookId"`
+	Url    string `json:"url"`
+	Format string `json:"format"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDeliveryResp struct {
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+func isValidWebhookFormat(format string) bool {
+	return format == WebhookFormatSlack || format == WebhookFormatDiscord || format == WebhookFormatGeneric
+}
+
+// チャットに投稿する文言
+func webhookMessage(ev *WebhookEvent) string {
+	switch ev.Type {
+	case WebhookEventGameStarted:
+		return "しりとりが始まりました"
+	case WebhookEventGameSucceeded:
+		return "今朝のしりとりは成功しました！"
+	case WebhookEventGameFailed:
+		return "今朝のしりとりは失敗しました"
+	case WebhookEventMemberJoined:
+		return fmt.Sprintf("%v さんがグループに参加しました", ev.Data["userName"])
+	case WebhookEventMemberLeft:
+		return fmt.Sprintf("%v さんがグループから抜けました", ev.Data["userName"])
+	case WebhookEventWakeUpTimeChanged:
+		return fmt.Sprintf("起床時刻が %v に変更されました", ev.Data["wakeUpTime"])
+	case WebhookEventWakeUpTimeProposed:
+		return fmt.Sprintf("%v さんが起床時刻を %v に変更することを提案しました", ev.Data["userName"], ev.Data["wakeUpTime"])
+	case WebhookEventMemberNudged:
+		return fmt.Sprintf("%v さんが %v さんを起こそうとしています", ev.Data["userName"], ev.Data["targetName"])
+	case WebhookEventStreakMilestone:
+		if userName, ok := ev.Data["userName"]; ok {
+			return fmt.Sprintf("%v さんが %v 日連続で早起きに成功しました", userName, ev.Data["days"])
+		}
+		return fmt.Sprintf("グループ全員が %v 日連続で早起きに成功しました", ev.Data["days"])
+	}
+	return ev.Type
+}
+
+func buildWebhookBody(hook *Webhook, ev *WebhookEvent) ([]byte, error) {
+	switch hook.Format {
+	case WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": webhookMessage(ev)})
+	case WebhookFormatDiscord:
+		return json.Marshal(map[string]string{"content": webhookMessage(ev)})
+	}
+	return json.Marshal(ev)
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(hook *Webhook, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Format == WebhookFormatGeneric {
+		req.Header.Set(WebhookEventHeader, event)
+		req.Header.Set(WebhookSignatureHeader, signWebhookBody(hook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// 失敗したら間隔を空けて再送し、各試行を記録する
+func deliverWebhook(app *App, hook Webhook, ev *WebhookEvent) {
+	body, err := buildWebhookBody(&hook, ev)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+		statusCode, err := postWebhook(&hook, ev.Type, body)
+
+		delivery := WebhookDelivery{
+			WebhookId:  hook.ID,
+			Event:      ev.Type,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Success:    err == nil,
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := app.db.Create(&delivery).Error; err != nil {
+			log.Error(err)
+		}
+
+		if delivery.Success || attempt == WebhookMaxAttempts {
+			return
+		}
+		time.Sleep(webhookRetryInterval * time.Duration(1<<(attempt-1)))
+	}
+}
+
+// グループに登録された全ての Webhook にイベントを送る
+func emitGroupEvent(app *App, groupId uint, eventType string, data map[string]interface{}) {
+	if groupId == 0 {
+		return
+	}
+
+	var hooks []Webhook
+	if err := app.db.Find(&hooks, "group_id = ?", groupId).Error; err != nil {
+		log.Error(err)
+		return
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	ev := &WebhookEvent{
+		Type:    eventType,
+		GroupId: groupId,
+		Data:    data,
+		Time:    time.Now(),
+	}
+	for _, hook := range hooks {
+		go deliverWebhook(app, hook, ev)
+	}
+}
+
+func handleAddWebhook(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	hookUrl, err := url.Parse(c.PostForm("url"))
+	if err != nil || (hookUrl.Scheme != "https" && hookUrl.Scheme != "http") || hookUrl.Hostname() == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	if err := checkWebhookHost(ctx, hookUrl.Hostname()); err != nil {
+		log.WithField("host", hookUrl.Hostname()).Info(err)
+		c.JSON(http.StatusNotAcceptable, map[string]interface{}{
+			"success": false,
+			"reason":  ErrMsgWebhookAddress,
+		})
+		return
+	}
+	format := c.DefaultPostForm("format", WebhookFormatGeneric)
+	if !isValidWebhookFormat(format) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	if role, err := getGroupRole(app.db, userId, groupId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	} else if !isGroupAdminRole(role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	hook := Webhook{
+		GroupId: groupId,
+		Url:     hookUrl.String(),
+		Format:  format,
+		Secret:  secret,
+	}
+	if err := app.db.Create(&hook).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// 署名の検証に必要なので秘密鍵は登録時にだけ返す
+	c.JSON(http.StatusCreated, WebhookResp{
+		Id:     hook.ID,
+		Url:    hook.Url,
+		Format: hook.Format,
+		Secret: hook.Secret,
+	})
+}
+
+func handleGetWebhooks(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	var hooks []Webhook
+	if err := app.db.Find(&hooks, "group_id = ?", groupId).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	hooksResp := make([]WebhookResp, 0)
+	for _, hook := range hooks {
+		hooksResp = append(hooksResp, WebhookResp{
+			Id:     hook.ID,
+			Url:    hook.Url,
+			Format: hook.Format,
+		})
+	}
+
+	c.JSON(http.StatusOK, hooksResp)
+}
+
+func handleDeleteWebhook(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	webhookId, err := strconv.ParseUint(c.PostForm("webhookId"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	if role, err := getGroupRole(app.db, userId, groupId); err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	} else if !isGroupAdminRole(role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if err := app.db.Where("id = ? AND group_id = ?", webhookId, groupId).Delete(&Webhook{}).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleGetWebhookDeliveries(app *App, c *gin.Context) {
+	sess := sessions.Default(c)
+	iUserId := sess.Get("user_id")
+	if iUserId == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	} else if _, ok := iUserId.(uint); !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userId := iUserId.(uint)
+
+	webhookId, err := strconv.ParseUint(c.Query("webhookId"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	groupId, err := getGroupId(app, c, userId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+
+	var hook Webhook
+	if err := app.db.First(&hook, "id = ? AND group_id = ?", webhookId, groupId).Error; err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var deliveries []WebhookDelivery
+	if err := app.db.Where("webhook_id = ?", hook.ID).Order("created_at desc").Limit(50).Find(&deliveries).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	deliveriesResp := make([]WebhookDeliveryResp, 0)
+	for _, d := range deliveries {
+		deliveriesResp = append(deliveriesResp, WebhookDeliveryResp{
+			Event:      d.Event,
+			Attempt:    d.Attempt,
+			StatusCode: d.StatusCode,
+			Success:    d.Success,
+			Error:      d.Error,
+			Time:       d.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, deliveriesResp)
+}
@@ -0,0 +1,162 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_buildWebhookBody(t *testing.T) {
+	ev := &WebhookEvent{
+		Type:    WebhookEventMemberJoined,
+		GroupId: 3,
+		Data: map[string]interface{}{
+			"userName": "taro",
+		},
+	}
+
+	testcases := []struct {
+		name   string
+		format string
+		key    string
+		result string
+	}{
+		{
+			name:   "slack",
+			format: WebhookFormatSlack,
+			key:    "text",
+			result: "taro さんがグループに参加しました",
+		},
+		{
+			name:   "discord",
+			format: WebhookFormatDiscord,
+			key:    "content",
+			result: "taro さんがグループに参加しました",
+		},
+		{
+			name:   "generic",
+			format: WebhookFormatGeneric,
+			key:    "event",
+			result: WebhookEventMemberJoined,
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			body, err := buildWebhookBody(&Webhook{Format: testcase.format}, ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(body, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded[testcase.key] != testcase.result {
+				t.Errorf("Unexpected %s: expected=%v, actual=%v\n", testcase.key, testcase.result, decoded[testcase.key])
+			}
+		})
+	}
+}
+
+func Test_postWebhook(t *testing.T) {
+	var signature, event string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(WebhookSignatureHeader)
+		event = r.Header.Get(WebhookEventHeader)
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	// テスト用のサーバはループバックアドレスで動いているので、確認しないクライアントを使う
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	webhookClient = server.Client()
+
+	hook := Webhook{
+		Url:    server.URL,
+		Format: WebhookFormatGeneric,
+		Secret: "secret",
+	}
+	body := []byte(`{"event":"game_started"}`)
+	statusCode, err := postWebhook(&hook, WebhookEventGameStarted, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %v", statusCode)
+	}
+	if event != WebhookEventGameStarted {
+		t.Errorf("Unexpected event header: %v", event)
+	}
+	if signature != signWebhookBody("secret", received) {
+		t.Errorf("Signature mismatch: %v", signature)
+	}
+}
+
+func Test_postWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	webhookClient = server.Client()
+
+	hook := Webhook{
+		Url:    server.URL,
+		Format: WebhookFormatSlack,
+	}
+	statusCode, err := postWebhook(&hook, WebhookEventGameFailed, []byte("{}"))
+	if err == nil {
+		t.Fatal("Server error should be reported")
+	}
+	if statusCode != http.StatusInternalServerError {
+		t.Errorf("Unexpected status: %v", statusCode)
+	}
+}
+
+func Test_checkWebhookHost(t *testing.T) {
+	testcases := []struct {
+		host   string
+		result error
+	}{
+		{host: "127.0.0.1", result: ErrWebhookAddress},
+		{host: "::1", result: ErrWebhookAddress},
+		{host: "0.0.0.0", result: ErrWebhookAddress},
+		{host: "10.1.2.3", result: ErrWebhookAddress},
+		{host: "172.16.0.1", result: ErrWebhookAddress},
+		{host: "192.168.1.1", result: ErrWebhookAddress},
+		{host: "169.254.169.254", result: ErrWebhookAddress},
+		{host: "100.64.0.1", result: ErrWebhookAddress},
+		{host: "fd00::1", result: ErrWebhookAddress},
+		{host: "::ffff:127.0.0.1", result: ErrWebhookAddress},
+		{host: "93.184.216.34", result: nil},
+		{host: "2606:2800:220:1:248:1893:25c8:1946", result: nil},
+	}
+	for _, testcase := range testcases {
+		result := checkWebhookHost(context.Background(), testcase.host)
+		if result != testcase.result {
+			t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.host, testcase.result, result)
+		}
+	}
+}
+
+func Test_postWebhookLoopback(t *testing.T) {
+	received := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+	}))
+	defer server.Close()
+
+	hook := Webhook{
+		Url:    server.URL,
+		Format: WebhookFormatSlack,
+	}
+	if _, err := postWebhook(&hook, WebhookEventGameFailed, []byte("{}")); !errors.Is(err, ErrWebhookAddress) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if received {
+		t.Error("Request to loopback address should be blocked")
+	}
+}
@@ -1,7 +1,6 @@
 package be
 
 import (
-	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -14,9 +13,10 @@ import (
 )
 
 const (
-	ErrMsgTime        = "参加可能な時間ではありません"
-	ErrMsgBadReq      = "不正なリクエストです"
-	ErrMsgServerError = "サーバーでエラーが発生しました"
+	ErrMsgTime            = "参加可能な時間ではありません"
+	ErrMsgLeaveDuringGame = "ゲーム中はグループから抜けられません。ゲームが終わってからもう一度お試しください"
+	ErrMsgBadReq          = "不正なリクエストです"
+	ErrMsgServerError     = "サーバーでエラーが発生しました"
 )
 
 const (
@@ -29,6 +29,9 @@ const (
 	EventTypeSendAnswer      = "sendAnswer"
 	EventTypeConfirmContinue = "confirmContinue"
 	EventTypeOnInput         = "onInput"
+	EventTypeNudge           = "nudge"
+	EventTypeOnNudge         = "onNudge"
+	EventTypeOnMemberLeft    = "onMemberLeft"
 )
 
 const (
@@ -37,6 +40,9 @@ const (
 	SecToFinish   = 300
 )
 
+// ゲームを管理するハブへの通知を待つ時間
+const MemberLeftNotifyTimeout = 5 * time.Second
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  64,
 	WriteBufferSize: 64,
@@ -60,12 +66,16 @@ type IEChangeTurn struct {
 	PrevPrefix string
 	PrevSuffix string
 	NextUserId uint
+	NextPlayer PlayerProfile
 }
 type IESendWord struct {
 	Word string
 }
 type IEConfirmContinue struct{}
-type IEStart struct{}
+type IEStart struct {
+	// 手番の順
+	Players []PlayerProfile
+}
 type IEFailure struct{}
 type IEError struct {
 	Reason string
@@ -74,6 +84,13 @@ type IEInput struct {
 	Value string
 }
 
+// ゲーム中にメンバーがグループから抜けた
+type IEMemberLeft struct {
+	Player PlayerProfile
+	// 残ったプレイヤー (手番の順)
+	Players []PlayerProfile
+}
+
 type InternalNotification struct {
 	EmitterUser uint
 	Payload     interface{}
@@ -81,7 +98,12 @@ type InternalNotification struct {
 
 type GameStates struct {
 	communicators map[uint]chan InternalNotification
-	gamesMu       sync.Mutex
+	// グループごとに接続中のユーザーと接続数
+	connected map[uint]map[uint]int
+	gamesMu   sync.Mutex
+	// 開始したゲームがあるグループ (ハブから更新するので gamesMu とは別にロックする)
+	started   map[uint]bool
+	startedMu sync.Mutex
 }
 
 type EventPayload struct {
@@ -89,19 +111,6 @@ type EventPayload struct {
 	Data map[string]interface{} `json:"data"`
 }
 
-func getGroupId(app *App, userId uint) (uint, error) {
-	var user Member
-	if err := app.db.First(&user, userId).Error; err != nil {
-		return 0, err
-	}
-
-	if user.GroupId == 0 {
-		return 0, errors.New("no group")
-	}
-
-	return user.GroupId, nil
-}
-
 func getStartTimeForGroup(app *App, groupId uint) (*time.Time, error) {
 	var group Group
 	if err := app.db.First(&group, groupId).Error; err != nil {
@@ -129,6 +138,15 @@ func isJoinableTime(startTime *time.Time) bool {
 	return now.After(startTime.Add(-10*time.Minute)) && now.Before(startTime.Add(10*time.Minute))
 }
 
+func containsUser(users []uint, userId uint) bool {
+	for _, uid := range users {
+		if uid == userId {
+			return true
+		}
+	}
+	return false
+}
+
 func appendUser(users []uint, userId uint) []uint {
 	for _, uid := range users {
 		if uid == userId {
@@ -138,6 +156,24 @@ func appendUser(users []uint, userId uint) []uint {
 	return append(users, userId)
 }
 
+func removeUser(users []uint, userId uint) ([]uint, int) {
+	for i, uid := range users {
+		if uid == userId {
+			return append(users[:i:i], users[i+1:]...), i
+		}
+	}
+	return users, -1
+}
+
+// 読み込めなかったプロフィールは空のまま返す
+func playerProfiles(users []uint, profiles map[uint]PlayerProfile) []PlayerProfile {
+	players := make([]PlayerProfile, 0)
+	for _, uid := range users {
+		players = append(players, profiles[uid])
+	}
+	return players
+}
+
 func notifyToEveryone(n InternalNotification, comminucators []chan InternalNotification) {
 	for _, c := range comminucators {
 		go func(c chan InternalNotification) {
@@ -152,8 +188,8 @@ func notifyToEveryone(n InternalNotification, comminucators []chan InternalNotif
 }
 
 func areAllMembersJoined(app *App, users []uint, groupId uint) (bool, error) {
-	var members []Member
-	if err := app.db.Find(&members, "group_id = ?", groupId).Error; err != nil {
+	members, err := getGroupMembers(app.db, groupId)
+	if err != nil {
 		return false, err
 	}
 
@@ -185,16 +221,71 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 	turnIndex := 0
 	prevWord := "おはよう"
 	gameStarted := false
+	allSucceeded := true
 	lastTickInfo := IETick{}
 	lastChangeTurnInfo := IEChangeTurn{}
+	profiles := make(map[uint]PlayerProfile)
+	lastNudge := make(map[uint]time.Time)
+	// 接続ごとの通知先とユーザー
+	channelUsers := make(map[chan InternalNotification]uint)
 	ticker := time.NewTicker(11 * time.Minute)
 	startTimer := time.NewTimer(startTime.Add(6 * time.Minute).Sub(time.Now()))
+
+	// 所属するメンバーが全員揃っていればゲームを始める
+	startIfAllJoined := func() error {
+		if len(users) == 0 {
+			return nil
+		}
+		joined, err := areAllMembersJoined(app, users, groupId)
+		if err != nil || !joined {
+			return err
+		}
+
+		gameStarted = true
+		s.startedMu.Lock()
+		s.started[groupId] = true
+		s.startedMu.Unlock()
+		ticker.Stop()
+		if !startTimer.Stop() {
+			<-startTimer.C
+		}
+		ticker = time.NewTicker(time.Second)
+
+		noti := InternalNotification{}
+		noti.Payload = IEStart{Players: playerProfiles(users, profiles)}
+		notifyToEveryone(noti, communicators)
+		go emitGroupEvent(app, groupId, WebhookEventGameStarted, nil)
+
+		prefix := shiritori.GetPrefix(prevWord)
+		suffix := shiritori.GetSuffix(prevWord)
+
+		lastChangeTurnInfo.PrevPrefix = prefix
+		lastChangeTurnInfo.PrevSuffix = suffix
+		lastChangeTurnInfo.NextUserId = users[turnIndex]
+		lastChangeTurnInfo.NextPlayer = profiles[users[turnIndex]]
+		noti.Payload = lastChangeTurnInfo
+		notifyToEveryone(noti, communicators)
+
+		noti.Payload = IETick{
+			Remain:     remain,
+			TurnRemain: turnRemain,
+		}
+		notifyToEveryone(noti, communicators)
+		return nil
+	}
 	for remain >= 0 {
 		select {
 		case <-startTimer.C:
 			// 全員揃わなかった為失敗
 			noti.Payload = IEFailure{}
 			notifyToEveryone(noti, communicators)
+			for _, u := range users {
+				if err := recordStat(app, u, groupId, *startTime, OutcomeFailed); err != nil {
+					log.Error(err)
+				}
+			}
+			go recordGameResult(app, groupId, *startTime, false, len(users))
+			go emitGroupEvent(app, groupId, WebhookEventGameFailed, nil)
 			goto deleteCommunicator
 
 		case <-ticker.C:
@@ -236,6 +327,7 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 					lastChangeTurnInfo.PrevPrefix = prefix
 					lastChangeTurnInfo.PrevSuffix = suffix
 					lastChangeTurnInfo.NextUserId = users[turnIndex]
+					lastChangeTurnInfo.NextPlayer = profiles[users[turnIndex]]
 					noti.Payload = lastChangeTurnInfo
 					notifyToEveryone(noti, communicators)
 				}
@@ -249,10 +341,19 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 
 				users = appendUser(users, noti.EmitterUser)
 				communicators = append(communicators, payload.Channel)
+				channelUsers[payload.Channel] = noti.EmitterUser
+				if _, ok := profiles[noti.EmitterUser]; !ok {
+					if profile, err := loadPlayerProfile(app.db, noti.EmitterUser); err != nil {
+						log.Error(err)
+					} else {
+						profiles[noti.EmitterUser] = profile
+					}
+				}
 
 				if gameStarted {
+					start := IEStart{Players: playerProfiles(users, profiles)}
 					go func() {
-						noti.Payload = IEStart{}
+						noti.Payload = start
 						payload.Channel <- noti
 
 						noti.Payload = lastTickInfo
@@ -262,38 +363,13 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 						payload.Channel <- noti
 					}()
 				} else {
-					if joined, err := areAllMembersJoined(app, users, groupId); err != nil {
+					if err := startIfAllJoined(); err != nil {
 						noti.Payload = IEError{
 							Reason: ErrMsgServerError,
 						}
 						notifyToEveryone(noti, communicators)
 
 						goto deleteCommunicator
-					} else if joined {
-						gameStarted = true
-						ticker.Stop()
-						if !startTimer.Stop() {
-							<-startTimer.C
-						}
-						ticker = time.NewTicker(time.Second)
-
-						noti.Payload = IEStart{}
-						notifyToEveryone(noti, communicators)
-
-						prefix := shiritori.GetPrefix(prevWord)
-						suffix := shiritori.GetSuffix(prevWord)
-
-						lastChangeTurnInfo.PrevPrefix = prefix
-						lastChangeTurnInfo.PrevSuffix = suffix
-						lastChangeTurnInfo.NextUserId = users[turnIndex]
-						noti.Payload = lastChangeTurnInfo
-						notifyToEveryone(noti, communicators)
-
-						noti.Payload = IETick{
-							Remain:     remain,
-							TurnRemain: turnRemain,
-						}
-						notifyToEveryone(noti, communicators)
 					}
 				}
 				break
@@ -320,6 +396,70 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 						break
 					}
 				}
+				delete(channelUsers, payload.Channel)
+				break
+
+			case IEMemberLeft:
+				// 抜けたメンバーの接続を切り、手番から外す
+				for i := 0; i < len(communicators); i++ {
+					if channelUsers[communicators[i]] == noti.EmitterUser {
+						delete(channelUsers, communicators[i])
+						close(communicators[i])
+						communicators[i] = communicators[len(communicators)-1]
+						communicators = communicators[:len(communicators)-1]
+						i--
+					}
+				}
+				var index int
+				users, index = removeUser(users, noti.EmitterUser)
+				delete(userFailCount, noti.EmitterUser)
+				if index >= 0 && len(users) == 0 {
+					goto deleteCommunicator
+				}
+				// 接続していなかったメンバーが抜けた場合も、待っているプレイヤーに知らせる
+				if _, ok := profiles[noti.EmitterUser]; !ok {
+					if profile, err := loadPlayerProfile(app.db, noti.EmitterUser); err != nil {
+						log.Error(err)
+					} else {
+						profiles[noti.EmitterUser] = profile
+					}
+				}
+				noti.Payload = IEMemberLeft{
+					Player:  profiles[noti.EmitterUser],
+					Players: playerProfiles(users, profiles),
+				}
+				notifyToEveryone(noti, communicators)
+
+				if !gameStarted {
+					// 抜けたメンバーを待っていた場合はすぐに始められる
+					if err := startIfAllJoined(); err != nil {
+						noti.Payload = IEError{
+							Reason: ErrMsgServerError,
+						}
+						notifyToEveryone(noti, communicators)
+
+						goto deleteCommunicator
+					}
+					break
+				}
+
+				if index < 0 {
+					break
+				} else if index < turnIndex {
+					turnIndex--
+				} else if index == turnIndex {
+					// 抜けたメンバーの番だった場合は次の人の番にする
+					turnIndex %= len(users)
+					turnRemain = SecPerTurn
+					waitingContinue = false
+
+					lastChangeTurnInfo.PrevPrefix = shiritori.GetPrefix(prevWord)
+					lastChangeTurnInfo.PrevSuffix = shiritori.GetSuffix(prevWord)
+					lastChangeTurnInfo.NextUserId = users[turnIndex]
+					lastChangeTurnInfo.NextPlayer = profiles[users[turnIndex]]
+					noti.Payload = lastChangeTurnInfo
+					notifyToEveryone(noti, communicators)
+				}
 				break
 
 			case IESendWord:
@@ -343,6 +483,7 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 					lastChangeTurnInfo.PrevPrefix = prefix
 					lastChangeTurnInfo.PrevSuffix = suffix
 					lastChangeTurnInfo.NextUserId = users[turnIndex]
+					lastChangeTurnInfo.NextPlayer = profiles[users[turnIndex]]
 					noti.Payload = lastChangeTurnInfo
 					notifyToEveryone(noti, communicators)
 				} else {
@@ -362,6 +503,7 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 						lastChangeTurnInfo.PrevPrefix = prefix
 						lastChangeTurnInfo.PrevSuffix = suffix
 						lastChangeTurnInfo.NextUserId = users[turnIndex]
+						lastChangeTurnInfo.NextPlayer = profiles[users[turnIndex]]
 						noti.Payload = lastChangeTurnInfo
 						notifyToEveryone(noti, communicators)
 					}
@@ -383,6 +525,27 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 				}
 				notifyToEveryone(noti, communicators)
 				break
+
+			case IENudge:
+				// 起こせるのはゲーム開始前にまだ接続していないメンバーだけ
+				if gameStarted || containsUser(users, payload.TargetId) {
+					notifyToEveryone(InternalNotification{
+						EmitterUser: noti.EmitterUser,
+						Payload:     IEError{Reason: ErrMsgNudgeTarget},
+					}, []chan InternalNotification{payload.Channel})
+					break
+				}
+				if last, ok := lastNudge[noti.EmitterUser]; ok && time.Since(last) < NudgeInterval {
+					notifyToEveryone(InternalNotification{
+						EmitterUser: noti.EmitterUser,
+						Payload:     IEError{Reason: ErrMsgNudgeTooOften},
+					}, []chan InternalNotification{payload.Channel})
+					break
+				}
+				lastNudge[noti.EmitterUser] = time.Now()
+				notifyToEveryone(noti, communicators)
+				go deliverNudge(app, groupId, *startTime, noti.EmitterUser, payload)
+				break
 			}
 			break
 		}
@@ -393,10 +556,23 @@ func manageGame(app *App, s *GameStates, groupId uint, startTime *time.Time, toH
 	log.Info(len(users))
 	for _, u := range users {
 		log.WithField("userId", u).WithField("failCount", userFailCount[u]).Info()
-		if err := recordStat(app, u, userFailCount[u] < 2); err != nil {
+		outcome := OutcomeFailed
+		if userFailCount[u] < 2 {
+			outcome = OutcomeSuccess
+		} else {
+			allSucceeded = false
+		}
+		if err := recordStat(app, u, groupId, *startTime, outcome); err != nil {
 			log.Error(err)
 		}
 	}
+	go recordGameResult(app, groupId, *startTime, allSucceeded, len(users))
+	go emitStreakMilestones(app, groupId, users)
+	if allSucceeded {
+		go emitGroupEvent(app, groupId, WebhookEventGameSucceeded, nil)
+	} else {
+		go emitGroupEvent(app, groupId, WebhookEventGameFailed, nil)
+	}
 	// 成功
 
 deleteCommunicator:
@@ -410,6 +586,51 @@ deleteCommunicator:
 	s.gamesMu.Lock()
 	defer s.gamesMu.Unlock()
 	delete(s.communicators, groupId)
+
+	s.startedMu.Lock()
+	defer s.startedMu.Unlock()
+	delete(s.started, groupId)
+}
+
+// グループのゲームが始まっていて、まだ終わっていないかどうか
+func (s *GameStates) isGameInProgress(groupId uint) bool {
+	s.startedMu.Lock()
+	defer s.startedMu.Unlock()
+	return s.started[groupId]
+}
+
+// グループから抜けたメンバーをゲームから外す (ゲームが行われていなければ何もしない)
+func (s *GameStates) notifyMemberLeft(groupId uint, userId uint) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	s.gamesMu.Lock()
+	toHub, ok := s.communicators[groupId]
+	s.gamesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	// ハブがループを抜けて結果を記録している間は受け取られないので、待ち続けない
+	// (ハブが終了して toHub が閉じられた場合は recover する)
+	select {
+	case toHub <- InternalNotification{
+		EmitterUser: userId,
+		Payload:     IEMemberLeft{},
+	}:
+	case <-time.After(MemberLeftNotifyTimeout):
+		log.WithField("groupId", groupId).Warn("Timed out notifying member left")
+	}
+}
+
+// ユーザーがグループのゲームに接続しているかどうか
+func (s *GameStates) isConnected(groupId uint, userId uint) bool {
+	s.gamesMu.Lock()
+	defer s.gamesMu.Unlock()
+	return s.connected[groupId][userId] > 0
 }
 
 // ゲームに接続する
@@ -428,6 +649,10 @@ func (s *GameStates) joinGame(app *App, startTime *time.Time, groupId uint, user
 		s.communicators[groupId] = toHub
 		go manageGame(app, s, groupId, startTime, toHub)
 	}
+	if _, ok := s.connected[groupId]; !ok {
+		s.connected[groupId] = make(map[uint]int)
+	}
+	s.connected[groupId][userId]++
 
 	notifier := make(chan InternalNotification)
 	noti := InternalNotification{}
@@ -441,13 +666,25 @@ func (s *GameStates) joinGame(app *App, startTime *time.Time, groupId uint, user
 }
 
 // ゲームから切断する
-func (s *GameStates) unjoinGame(userId uint, notifier chan InternalNotification, toHub chan InternalNotification) {
+func (s *GameStates) unjoinGame(groupId uint, userId uint, notifier chan InternalNotification, toHub chan InternalNotification) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error(err)
 		}
 	}()
 
+	s.gamesMu.Lock()
+	if users, ok := s.connected[groupId]; ok {
+		users[userId]--
+		if users[userId] <= 0 {
+			delete(users, userId)
+		}
+		if len(users) == 0 {
+			delete(s.connected, groupId)
+		}
+	}
+	s.gamesMu.Unlock()
+
 	noti := InternalNotification{}
 	noti.EmitterUser = userId
 	noti.Payload = IEUnjoinMember{
@@ -477,7 +714,7 @@ func handleSocketConnection(app *App, c *gin.Context) {
 	defer conn.Close()
 
 	// 所属するグループのIDを取得
-	groupId, err := getGroupId(app, userId)
+	groupId, err := getGroupId(app, c, userId)
 	if err != nil {
 		log.Error(err)
 		return
@@ -564,6 +801,48 @@ func handleSocketConnection(app *App, c *gin.Context) {
 				}
 				toHub <- intNoti
 				break
+
+			case EventTypeNudge:
+				targetName := ev.Data["userName"]
+				if _, ok := targetName.(string); !ok {
+					conn.WriteJSON(EventPayload{
+						Type: EventTypeOnError,
+						Data: map[string]interface{}{
+							"reason": ErrMsgBadReq,
+						},
+					})
+					goto next
+				}
+				target, err := findNudgeTarget(app, groupId, targetName.(string))
+				if err != nil || target.ID == userId {
+					conn.WriteJSON(EventPayload{
+						Type: EventTypeOnError,
+						Data: map[string]interface{}{
+							"reason": ErrMsgNudgeTarget,
+						},
+					})
+					goto next
+				}
+				var sender Member
+				if err := app.db.First(&sender, userId).Error; err != nil {
+					log.Error(err)
+					goto next
+				}
+				nudgeProfiles, err := getProfiles(app.db, []uint{sender.ID, target.ID})
+				if err != nil {
+					log.Error(err)
+					goto next
+				}
+				intNoti.Payload = IENudge{
+					Channel:       notificationChan,
+					SenderName:    sender.UserName,
+					SenderProfile: makePlayerProfile(&sender, nudgeProfiles[sender.ID]),
+					TargetId:      target.ID,
+					TargetName:    target.UserName,
+					TargetProfile: makePlayerProfile(target, nudgeProfiles[target.ID]),
+				}
+				toHub <- intNoti
+				break
 			}
 		next:
 		}
@@ -607,6 +886,7 @@ func handleSocketConnection(app *App, c *gin.Context) {
 						"prevPrefix": data.PrevPrefix,
 						"prevSuffix": data.PrevSuffix,
 						"yourTurn":   data.NextUserId == userId,
+						"nextPlayer": data.NextPlayer,
 					},
 				}
 				if err := conn.WriteJSON(payload); err != nil {
@@ -618,6 +898,9 @@ func handleSocketConnection(app *App, c *gin.Context) {
 			case IEStart:
 				payload := EventPayload{
 					Type: EventTypeOnStart,
+					Data: map[string]interface{}{
+						"players": data.Players,
+					},
 				}
 				if err := conn.WriteJSON(payload); err != nil {
 					log.Error(err)
@@ -661,6 +944,34 @@ func handleSocketConnection(app *App, c *gin.Context) {
 					log.Error(err)
 					goto disconnect
 				}
+
+			case IEMemberLeft:
+				payload := EventPayload{
+					Type: EventTypeOnMemberLeft,
+					Data: map[string]interface{}{
+						"player":  data.Player,
+						"players": data.Players,
+					},
+				}
+				if err := conn.WriteJSON(payload); err != nil {
+					log.Error(err)
+					goto disconnect
+				}
+
+			case IENudge:
+				payload := EventPayload{
+					Type: EventTypeOnNudge,
+					Data: map[string]interface{}{
+						"from":        data.SenderName,
+						"to":          data.TargetName,
+						"fromProfile": data.SenderProfile,
+						"toProfile":   data.TargetProfile,
+					},
+				}
+				if err := conn.WriteJSON(payload); err != nil {
+					log.Error(err)
+					goto disconnect
+				}
 			}
 		case <-finishChan:
 			goto disconnect
@@ -668,5 +979,5 @@ func handleSocketConnection(app *App, c *gin.Context) {
 	}
 
 disconnect:
-	app.gameStates.unjoinGame(userId, notificationChan, toHub)
+	app.gameStates.unjoinGame(groupId, userId, notificationChan, toHub)
 }
@@ -0,0 +1,81 @@
+package be
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_removeUser(t *testing.T) {
+	testcases := []struct {
+		name   string
+		users  []uint
+		userId uint
+		result []uint
+		index  int
+	}{
+		{name: "first", users: []uint{1, 2, 3}, userId: 1, result: []uint{2, 3}, index: 0},
+		{name: "middle", users: []uint{1, 2, 3}, userId: 2, result: []uint{1, 3}, index: 1},
+		{name: "last", users: []uint{1, 2, 3}, userId: 3, result: []uint{1, 2}, index: 2},
+		{name: "not joined", users: []uint{1, 2, 3}, userId: 4, result: []uint{1, 2, 3}, index: -1},
+	}
+	for _, testcase := range testcases {
+		result, index := removeUser(testcase.users, testcase.userId)
+		if index != testcase.index || len(result) != len(testcase.result) {
+			t.Errorf("Unexpected result for %s: expected=%v (%v), actual=%v (%v)\n", testcase.name, testcase.result, testcase.index, result, index)
+			continue
+		}
+		for i := range result {
+			if result[i] != testcase.result[i] {
+				t.Errorf("Unexpected result for %s: expected=%v, actual=%v\n", testcase.name, testcase.result, result)
+				break
+			}
+		}
+	}
+}
+
+func Test_notifyMemberLeftWithoutGame(t *testing.T) {
+	s := &GameStates{
+		communicators: make(map[uint]chan InternalNotification),
+		connected:     make(map[uint]map[uint]int),
+		started:       make(map[uint]bool),
+	}
+	// ゲームが行われていなければ何もしない
+	s.notifyMemberLeft(1, 1)
+	if s.isGameInProgress(1) {
+		t.Errorf("Game is in progress without a hub\n")
+	}
+}
+
+func Test_notifyMemberLeftReleasesLock(t *testing.T) {
+	toHub := make(chan InternalNotification)
+	s := &GameStates{
+		communicators: map[uint]chan InternalNotification{1: toHub},
+		connected:     make(map[uint]map[uint]int),
+		started:       make(map[uint]bool),
+	}
+
+	// ハブが受け取らない間も、他のグループの処理が止まらない
+	done := make(chan struct{})
+	go func() {
+		s.notifyMemberLeft(1, 1)
+		close(done)
+	}()
+	checked := make(chan struct{})
+	go func() {
+		s.isConnected(2, 1)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("isConnected is blocked while notifying\n")
+	}
+
+	// ハブが終了した場合は送信をやめる
+	close(toHub)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifyMemberLeft did not return after the hub finished\n")
+	}
+}
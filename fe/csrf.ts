@@ -0,0 +1,5 @@
+// サーバーが Cookie に設定した CSRF 対策のトークン
+export const csrfToken = (): string => {
+    const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : '';
+};
@@ -1,4 +1,5 @@
 import './game.scss';
+import { csrfToken } from './csrf';
 
 const bgm = new Audio('/assets/ryugen.mp3');
 bgm.loop = true;
@@ -26,6 +27,11 @@ const handleCompositionEnd = (el: HTMLInputElement) => {
     el.value = String.fromCharCode(...resultStr);
 };
 
+// 画面に表示しているグループ (複数のグループに所属している場合は最初のもの)
+let currentGroupId = null;
+
+const groupIdParam = () => (currentGroupId === null ? '' : `&groupId=${currentGroupId}`);
+
 const showUserInfo = () => {
     fetch('/users/info')
         .then((resp) => resp.json())
@@ -34,6 +40,7 @@ const showUserInfo = () => {
 
             document.getElementById('successRate').innerText = resp['successRate'];
             if (resp['joinedGroup']) {
+                currentGroupId = resp['groupInfo']['id'];
                 document.getElementById('startTime').innerText = resp['groupInfo']['wakeUpTime'];
                 (document.getElementById('timeInput') as HTMLInputElement).value =
                     resp['groupInfo']['wakeUpTime'];
@@ -51,6 +58,7 @@ const showUserInfo = () => {
                     }
                 }
             } else {
+                currentGroupId = null;
                 document.getElementById('timeContainer').setAttribute('data-activated', 'no');
                 document.getElementById('noFriendsTip').setAttribute('data-activated', 'yes');
                 document
@@ -89,6 +97,7 @@ const showInvitations = () => {
                         body: `invitationId=${inv['invitationId']}`,
                         headers: {
                             'Content-Type': 'application/x-www-form-urlencoded',
+                            'X-CSRF-Token': csrfToken(),
                         },
                     })
                         .then((resp) => {
@@ -116,6 +125,7 @@ const showInvitations = () => {
                         body: `invitationId=${inv['invitationId']}`,
                         headers: {
                             'Content-Type': 'application/x-www-form-urlencoded',
+                            'X-CSRF-Token': csrfToken(),
                         },
                     })
                         .then((resp) => {
@@ -147,9 +157,41 @@ const showInvitations = () => {
         });
 };
 
+// 招待リンク (/game/?invite=...) から開いた場合はそのグループに参加する
+const joinByInviteLink = () => {
+    const code = new URLSearchParams(location.search).get('invite');
+    if (code === null) {
+        return;
+    }
+    history.replaceState(null, '', location.pathname);
+    fetch('/groups/join_code', {
+        method: 'post',
+        body: `code=${encodeURIComponent(code)}`,
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+            'X-CSRF-Token': csrfToken(),
+        },
+    })
+        .then((resp) => resp.json())
+        .then((resp) => {
+            if (!resp['success']) {
+                document.getElementById('alertMessage').innerText = resp['reason'];
+                document.getElementById('alert').setAttribute('data-activated', 'yes');
+                return;
+            }
+            showUserInfo();
+        })
+        .catch((err) => {
+            console.error(err);
+            document.getElementById('alertMessage').innerText = '通信に失敗しました';
+            document.getElementById('alert').setAttribute('data-activated', 'yes');
+        });
+};
+
 addEventListener('load', () => {
     showUserInfo();
     showInvitations();
+    joinByInviteLink();
 
     let sock = null;
     let stillWaitingRetry = false;
@@ -177,7 +219,7 @@ addEventListener('load', () => {
             addr = 'ws://';
         }
         addr += location.host;
-        addr += '/game_ws';
+        addr += `/game_ws?csrf_token=${encodeURIComponent(csrfToken())}${groupIdParam()}`;
 
         sock = new WebSocket(addr);
         sock.addEventListener('close', (err) => {
@@ -367,17 +409,30 @@ addEventListener('load', () => {
 
         fetch('/groups/wake_up_time', {
             method: 'post',
-            body: `time=${encodeURI(value)}`,
+            body: `time=${encodeURI(value)}${groupIdParam()}`,
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
+                'X-CSRF-Token': csrfToken(),
             },
         })
-            .then((resp) => {
+            .then(async (resp) => {
+                if (resp.status === 406) {
+                    document.getElementById('alertMessage').innerText = (await resp.json())['reason'];
+                    document.getElementById('alert').setAttribute('data-activated', 'yes');
+                    return;
+                }
                 if (resp.status !== 200) {
                     document.getElementById('alertMessage').innerText = '設定に失敗しました';
                     document.getElementById('alert').setAttribute('data-activated', 'yes');
                     return;
                 }
+                const data = await resp.json();
+                if (data['status'] !== 'applied') {
+                    // 他のメンバーが賛成するか、期限が来てから変更される
+                    document.getElementById('alertMessage').innerText =
+                        '起床時刻の変更を提案しました。他のメンバーが賛成すると変更されます';
+                    document.getElementById('alert').setAttribute('data-activated', 'yes');
+                }
                 showUserInfo();
                 document.getElementById('timeSettingsOverlay').setAttribute('data-activated', 'no');
             })
@@ -413,17 +468,23 @@ addEventListener('load', () => {
     document.getElementById('friendSearchInviteButton').addEventListener('click', () => {
         fetch('/groups/invite', {
             method: 'post',
-            body: `player=${encodeURI(userName)}`,
+            body: `player=${encodeURI(userName)}${groupIdParam()}`,
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
+                'X-CSRF-Token': csrfToken(),
             },
         })
-            .then((resp) => {
+            .then(async (resp) => {
                 if (resp.status !== 201) {
                     document
                         .getElementById('friendSearchResultContainer')
                         .setAttribute('data-found', 'no');
-                    document.getElementById('alertMessage').innerText = '招待に失敗しました';
+                    let reason = '招待に失敗しました';
+                    if (resp.status === 406) {
+                        // 招待済みや参加済みの場合は理由が返される
+                        reason = (await resp.json().catch(() => ({})))['reason'] || reason;
+                    }
+                    document.getElementById('alertMessage').innerText = reason;
                     document.getElementById('alert').setAttribute('data-activated', 'yes');
                     return;
                 }
@@ -1,32 +1,99 @@
 import './style.scss';
+import { csrfToken } from './csrf';
+
+const showError = (message: string) => {
+    const errorBar = document.getElementById('errorBar');
+    errorBar.innerText = message;
+    errorBar.setAttribute('data-activated', 'yes');
+};
+
+// 二段階認証を有効にしている場合は確認コードを入力してもらう
+const showTotpForm = () => {
+    document.getElementById('loginForm').hidden = true;
+    document.getElementById('totpForm').hidden = false;
+    document.getElementById('errorBar').setAttribute('data-activated', 'no');
+};
+
+const showLoginForm = () => {
+    document.getElementById('loginForm').hidden = false;
+    document.getElementById('totpForm').hidden = true;
+};
 
 addEventListener('load', () => {
+    // OpenID Connect でログインした場合はここに戻ってくる
+    if (new URLSearchParams(location.search).get('totpRequired') === '1') {
+        showTotpForm();
+    }
+
     document.getElementById('loginForm').addEventListener('submit', (ev) => {
         ev.preventDefault();
 
         const userName = (document.getElementById('userName') as HTMLInputElement).value;
         const password = (document.getElementById('password') as HTMLInputElement).value;
 
-        const errorBar = document.getElementById('errorBar');
-
         fetch('/users/login', {
             method: 'post',
-            body: `userName=${encodeURI(userName)}&password=${encodeURI(password)}`,
+            body: `userName=${encodeURIComponent(userName)}&password=${encodeURIComponent(password)}`,
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
+                'X-CSRF-Token': csrfToken(),
             },
         })
             .then((resp) => {
+                if (resp.status === 429) {
+                    return resp.json().then((body) => showError(body['reason']));
+                }
                 if (resp.status !== 200) {
-                    errorBar.innerText = 'ユーザー名またはパスワードが間違っています';
-                    errorBar.setAttribute('data-activated', 'yes');
+                    showError('ユーザー名またはパスワードが間違っています');
+                    return;
+                }
+                return resp.json().then((body) => {
+                    if (body['totpRequired']) {
+                        showTotpForm();
+                        return;
+                    }
+                    location.href = '/game/';
+                });
+            })
+            .catch((err) => {
+                showError('サーバーとの通信に失敗しました');
+            });
+    });
+
+    document.getElementById('totpForm').addEventListener('submit', (ev) => {
+        ev.preventDefault();
+
+        const code = (document.getElementById('totpCode') as HTMLInputElement).value;
+        const useRecoveryCode = (document.getElementById('useRecoveryCode') as HTMLInputElement)
+            .checked;
+        const field = useRecoveryCode ? 'recoveryCode' : 'code';
+
+        fetch('/users/login/totp', {
+            method: 'post',
+            body: `${field}=${encodeURIComponent(code)}`,
+            headers: {
+                'Content-Type': 'application/x-www-form-urlencoded',
+                'X-CSRF-Token': csrfToken(),
+            },
+        })
+            .then((resp) => {
+                if (resp.status === 200) {
+                    location.href = '/game/';
                     return;
                 }
-                location.href = '/game/';
+                return resp
+                    .json()
+                    .catch(() => ({}))
+                    .then((body) => {
+                        // 時間切れなどでパスワードの確認からやり直す場合
+                        if (body['loginRequired'] || !body['reason']) {
+                            showLoginForm();
+                        }
+                        showError(body['reason'] || 'もう一度ログインしてください');
+                    });
             })
             .catch((err) => {
-                errorBar.innerText = 'サーバーとの通信に失敗しました';
-                errorBar.setAttribute('data-activated', 'yes');
+                showError('サーバーとの通信に失敗しました');
             });
     });
 });
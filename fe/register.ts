@@ -1,4 +1,5 @@
 import './style.scss';
+import { csrfToken } from './csrf';
 
 addEventListener('load', () => {
     document.getElementById('registerForm').addEventListener('submit', (ev) => {
@@ -22,6 +23,7 @@ addEventListener('load', () => {
             body: `userName=${encodeURI(userName)}&password=${encodeURI(password)}`,
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
+                'X-CSRF-Token': csrfToken(),
             },
         })
             .then((resp) => resp.json())
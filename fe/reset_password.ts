@@ -0,0 +1,78 @@
+import './style.scss';
+import { csrfToken } from './csrf';
+
+const showError = (message: string) => {
+    const errorBar = document.getElementById('errorBar');
+    errorBar.innerText = message;
+    errorBar.setAttribute('data-activated', 'yes');
+};
+
+const postForm = (url: string, body: string): Promise<Response> =>
+    fetch(url, {
+        method: 'POST',
+        body,
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+            'X-CSRF-Token': csrfToken(),
+        },
+    });
+
+addEventListener('load', () => {
+    const token = new URLSearchParams(location.search).get('token');
+    const requestForm = document.getElementById('requestForm');
+    const resetForm = document.getElementById('resetForm');
+    // メールの URL から開いた場合は新しいパスワードを入力してもらう
+    if (token) {
+        requestForm.hidden = true;
+        resetForm.hidden = false;
+    }
+
+    requestForm.addEventListener('submit', (ev) => {
+        ev.preventDefault();
+
+        const userName = (document.getElementById('userName') as HTMLInputElement).value;
+        postForm('/users/password/reset_request', `userName=${encodeURIComponent(userName)}`)
+            .then((resp) => {
+                if (resp.status === 429) {
+                    return resp.json().then((body) => showError(body['reason']));
+                }
+                if (resp.status !== 202) {
+                    showError('メールを送れませんでした');
+                    return;
+                }
+                document.getElementById('errorBar').setAttribute('data-activated', 'no');
+                document.getElementById('requestSent').hidden = false;
+            })
+            .catch((err) => {
+                showError('サーバーとの通信に失敗しました');
+            });
+    });
+
+    resetForm.addEventListener('submit', (ev) => {
+        ev.preventDefault();
+
+        const password = (document.getElementById('password') as HTMLInputElement).value;
+        const passwordConfirm = (document.getElementById('passwordConfirm') as HTMLInputElement)
+            .value;
+        if (password !== passwordConfirm) {
+            showError('パスワードが一致しません');
+            return;
+        }
+
+        postForm(
+            '/users/password/reset',
+            `token=${encodeURIComponent(token)}&password=${encodeURIComponent(password)}`,
+        )
+            .then((resp) => resp.json())
+            .then((resp) => {
+                if (!resp['success']) {
+                    showError(resp['reason']);
+                    return;
+                }
+                location.href = '/';
+            })
+            .catch((err) => {
+                showError('サーバーとの通信に失敗しました');
+            });
+    });
+});
@@ -16,6 +16,7 @@ module.exports = {
         register: './fe/register.ts',
         game: './fe/game.ts',
         finish: './fe/finish.ts',
+        reset_password: './fe/reset_password.ts',
     },
     output: {
         path: path.join(__dirname, 'dist'),
@@ -62,6 +63,11 @@ module.exports = {
             filename: 'finish/index.html',
             chunks: ['finish'],
         }),
+        new HtmlPlugin({
+            template: 'fe/reset_password.html',
+            filename: 'reset_password/index.html',
+            chunks: ['reset_password'],
+        }),
         new CopyPlugin({
             patterns: [
                 {from: 'fe/assets/ryugen.mp3', to: path.join(__dirname, 'dist/assets')},